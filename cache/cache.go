@@ -4,9 +4,13 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"time"
 
 	"git.numtide.com/numtide/treefmt/stats"
@@ -19,59 +23,111 @@ import (
 	"github.com/adrg/xdg"
 	"github.com/vmihailenco/msgpack/v5"
 	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	pathsBucket      = "paths"
 	formattersBucket = "formatters"
+	metaBucket       = "meta"
+
+	// rootKey is the key in the meta bucket under which the tree root is recorded
+	rootKey = "root"
+
+	// DBName is the name of the cache database within a configured cache directory.
+	DBName = "eval-cache.db"
 )
 
 // Entry represents a cache entry, indicating the last size and modified time for a file path.
+// For paths, Formatters records the fingerprints of the formatters which matched the path when it was last processed,
+// and Hash records a content hash of the file, used to confirm it has been renamed.
+// For formatters, Hash optionally records a content hash of the executable, and Config records a hash of the
+// formatter's configuration.
 type Entry struct {
-	Size     int64
-	Modified time.Time
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	Hash       string    `json:"hash,omitempty" msgpack:",omitempty"`
+	Config     string    `json:"config,omitempty" msgpack:",omitempty"`
+	Formatters []string  `json:"formatters,omitempty" msgpack:",omitempty"`
 }
 
 var (
 	db     *bolt.DB
 	logger *log.Logger
 
+	// set when the cache is being read by a command managing it, in which case changes are detected but not recorded
+	readOnly bool
+
+	// the configured formatters, and their fingerprints by name
+	formatters   map[string]*format.Formatter
+	fingerprints map[string]string
+	// the formatters which are new or have changed since the last invocation
+	changed []*format.Formatter
+
 	ReadBatchSize = 1024 * runtime.NumCPU()
 )
 
 // Open creates an instance of bolt.DB for a given treeRoot path.
 // If clean is true, Open will delete any existing data in the cache.
 //
-// The database will be located in `XDG_CACHE_DIR/treefmt/eval-cache/<id>.db`, where <id> is determined by hashing
-// the treeRoot path. This associates a given treeRoot with a given instance of the cache.
-func Open(treeRoot string, clean bool, formatters map[string]*format.Formatter) (err error) {
+// Formatters which are new or have changed since the last invocation are recorded, so that ChangeSet can emit any
+// paths they match, or used to match, without invalidating the entries of paths which are unaffected.
+//
+// The database will be located in `dir`, if specified, otherwise in `XDG_CACHE_DIR/treefmt/eval-cache/<id>.db`,
+// where <id> is determined by hashing the treeRoot path. See Locate.
+//
+// Invocations formatting the same tree are serialised by LockTree, so the database is otherwise only in use by
+// commands managing it, such as `treefmt cache info`. If a command reading it holds it for longer than LockTimeout, it
+// is opened read-only instead, in which case the cache is consulted but not updated. If a command is writing to it,
+// ErrInUse is returned.
+func Open(treeRoot string, dir string, clean bool, configured map[string]*format.Formatter) (err error) {
 	logger = log.WithPrefix("cache")
 
-	// determine a unique and consistent db name for the tree root
-	h := sha1.New()
-	h.Write([]byte(treeRoot))
-	digest := h.Sum(nil)
+	formatters = configured
+	fingerprints = make(map[string]string)
+	changed = nil
+	readOnly = false
 
-	name := hex.EncodeToString(digest)
-	path, err := xdg.CacheFile(fmt.Sprintf("treefmt/eval-cache/%v.db", name))
-	if err != nil {
-		return fmt.Errorf("could not resolve local path for the cache: %w", err)
+	path := Locate(treeRoot, dir)
+	if err = createDir(filepath.Dir(path), treeRoot); err != nil {
+		return fmt.Errorf("could not create directory for the cache: %w", err)
 	}
 
-	db, err = bolt.Open(path, 0o600, nil)
+	db, err = openWithTimeout(path, false)
+	if errors.Is(err, ErrInUse) && !clean {
+		logger.Warnf("%v, opening it read-only so it will not be updated", err)
+		readOnly = true
+		db, err = openWithTimeout(path, true)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to open cache at %v: %w", path, err)
+		return err
+	}
+
+	run := db.Update
+	if readOnly {
+		run = db.View
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = run(func(tx *bolt.Tx) error {
+		if !readOnly {
+			// record the tree root, so the cache can be pruned once it no longer exists
+			metaBucket, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+			if err != nil {
+				return fmt.Errorf("failed to create meta bucket: %w", err)
+			}
+			if err = metaBucket.Put([]byte(rootKey), []byte(treeRoot)); err != nil {
+				return fmt.Errorf("failed to record tree root: %w", err)
+			}
+		}
+
 		// create bucket for tracking paths
-		pathsBucket, err := tx.CreateBucketIfNotExists([]byte(pathsBucket))
+		pathsBucket, err := createBucket(tx, pathsBucket)
 		if err != nil {
 			return fmt.Errorf("failed to create paths bucket: %w", err)
 		}
 
 		// create bucket for tracking formatters
-		formattersBucket, err := tx.CreateBucketIfNotExists([]byte(formattersBucket))
+		formattersBucket, err := createBucket(tx, formattersBucket)
 		if err != nil {
 			return fmt.Errorf("failed to create formatters bucket: %w", err)
 		}
@@ -89,8 +145,13 @@ func Open(treeRoot string, clean bool, formatters map[string]*format.Formatter)
 				return fmt.Errorf("failed to retrieve cache entry for formatter %v: %w", name, err)
 			}
 
+			hash := formatter.Hash()
+			configHash := formatter.ConfigHash()
+
 			isNew := entry == nil
-			hasChanged := entry != nil && !(entry.Size == stat.Size() && entry.Modified == stat.ModTime())
+			hasChanged := entry != nil &&
+				!(entry.Size == stat.Size() && entry.Modified == stat.ModTime() && entry.Hash == hash &&
+					entry.Config == configHash)
 
 			if isNew {
 				logger.Debugf("formatter '%s' is new", name)
@@ -101,19 +162,29 @@ func Open(treeRoot string, clean bool, formatters map[string]*format.Formatter)
 					"modTime", stat.ModTime(),
 					"cachedSize", entry.Size,
 					"cachedModTime", entry.Modified,
+					"hash", hash,
+					"cachedHash", entry.Hash,
+					"config", configHash,
+					"cachedConfig", entry.Config,
 				)
 			}
 
-			// update overall clean flag
-			clean = clean || isNew || hasChanged
+			if isNew || hasChanged {
+				changed = append(changed, formatter)
+			}
 
 			// record formatters info
 			entry = &Entry{
 				Size:     stat.Size(),
 				Modified: stat.ModTime(),
+				Hash:     hash,
+				Config:   configHash,
 			}
+			fingerprints[name] = fingerprint(name, entry)
 
-			if err = putEntry(formattersBucket, name, entry); err != nil {
+			if readOnly {
+				continue
+			} else if err = putEntry(formattersBucket, name, entry); err != nil {
 				return fmt.Errorf("failed to write cache entry for formatter %v: %w", name, err)
 			}
 		}
@@ -121,13 +192,13 @@ func Open(treeRoot string, clean bool, formatters map[string]*format.Formatter)
 		// check for any removed formatters
 		if err = formattersBucket.ForEach(func(key []byte, _ []byte) error {
 			_, ok := formatters[string(key)]
-			if !ok {
+			if !ok && !readOnly {
 				// remove the formatter entry from the cache
+				// any paths it matched will be emitted, as its fingerprint is no longer current
+				logger.Debugf("formatter '%s' has been removed", key)
 				if err = formattersBucket.Delete(key); err != nil {
 					return fmt.Errorf("failed to remove cache entry for formatter %v: %w", key, err)
 				}
-				// indicate a clean is required
-				clean = true
 			}
 			return nil
 		}); err != nil {
@@ -150,6 +221,82 @@ func Open(treeRoot string, clean bool, formatters map[string]*format.Formatter)
 	return
 }
 
+// createBucket returns the named bucket, creating it if necessary unless the cache is read-only.
+func createBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	if !readOnly {
+		return tx.CreateBucketIfNotExists([]byte(name))
+	} else if bucket := tx.Bucket([]byte(name)); bucket != nil {
+		return bucket, nil
+	}
+	return nil, bolt.ErrBucketNotFound
+}
+
+// Dir returns the directory containing the cache databases for all trees, `XDG_CACHE_DIR/treefmt/eval-cache`.
+func Dir() string {
+	return filepath.Join(xdg.CacheHome, "treefmt", "eval-cache")
+}
+
+// Path returns the location of the cache database for treeRoot, named by hashing the treeRoot path.
+func Path(treeRoot string) string {
+	return filepath.Join(Dir(), treeID(treeRoot)+".db")
+}
+
+// treeID identifies treeRoot by hashing its path.
+func treeID(treeRoot string) string {
+	digest := sha1.Sum([]byte(treeRoot))
+	return hex.EncodeToString(digest[:])
+}
+
+// Locate returns the location of the cache database for treeRoot. If dir has been specified, the database is stored
+// within it as DBName. As entries are keyed by paths relative to the tree root, such a cache can be moved or restored
+// along with the tree. Otherwise, it is located at Path(treeRoot), which associates a given treeRoot with a given
+// instance of the cache.
+func Locate(treeRoot string, dir string) string {
+	if dir != "" {
+		return filepath.Join(dir, DBName)
+	}
+	return Path(treeRoot)
+}
+
+// createDir creates dir if necessary. If dir is within treeRoot, it is populated with ignore files matching everything
+// within it, which ensures the cache directory is neither committed nor walked. Directories outside the tree, such as
+// those in the user's cache directory, are left alone.
+func createDir(dir string, treeRoot string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %v: %w", dir, err)
+	}
+
+	if !withinTree(dir, treeRoot) {
+		return nil
+	}
+
+	for _, name := range []string{".gitignore", walk.TreefmtIgnoreFile} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.WriteFile(path, []byte("*\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to write %v: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// withinTree returns true if dir is beneath treeRoot. The tree root itself is not considered to be within the tree, as
+// ignoring everything within it would prevent anything from being formatted.
+func withinTree(dir string, treeRoot string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil || treeRoot == "" {
+		return false
+	}
+	relPath, err := filepath.Rel(treeRoot, dir)
+	if err != nil {
+		return false
+	}
+	return !(relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)))
+}
+
 // Close closes any open instance of the cache.
 func Close() error {
 	if db == nil {
@@ -158,6 +305,45 @@ func Close() error {
 	return db.Close()
 }
 
+// fingerprint identifies a formatter, combining its name with the state of its executable and configuration.
+func fingerprint(name string, entry *Entry) string {
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "%s\n%d\n%d\n%s\n%s", name, entry.Size, entry.Modified.UnixNano(), entry.Hash, entry.Config)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// matching returns the sorted fingerprints of the formatters which match relPath.
+func matching(relPath string) []string {
+	var result []string
+	for name, formatter := range formatters {
+		if formatter.Matches(relPath) {
+			result = append(result, fingerprints[name])
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// formattersChanged returns true if any of the formatters which matched a path when it was last processed have since
+// changed or been removed, or if any new or changed formatters match it now.
+func formattersChanged(relPath string, cached *Entry) bool {
+LOOP:
+	for _, fp := range cached.Formatters {
+		for _, current := range fingerprints {
+			if fp == current {
+				continue LOOP
+			}
+		}
+		return true
+	}
+	for _, formatter := range changed {
+		if formatter.Matches(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
 // getEntry is a helper for reading cache entries from bolt.
 func getEntry(bucket *bolt.Bucket, path string) (*Entry, error) {
 	b := bucket.Get([]byte(path))
@@ -187,7 +373,11 @@ func putEntry(bucket *bolt.Bucket, path string, entry *Entry) error {
 
 // ChangeSet is used to walk a filesystem, starting at root, and outputting any new or changed paths using pathsCh.
 // It determines if a path is new or has changed by comparing against cache entries.
-func ChangeSet(ctx context.Context, walker walk.Walker, filesCh chan<- *walk.File) error {
+//
+// If prune is true, the walker is expected to walk the whole tree. Once it has finished, the entries for any paths
+// which were not walked are removed. New paths with the same size and mod time as an entry for a path which no longer
+// exists are recognised as renames, and are not output if they are matched by the same formatters as before.
+func ChangeSet(ctx context.Context, walker walk.Walker, filesCh chan<- *walk.File, prune bool) error {
 	start := time.Now()
 
 	defer func() {
@@ -198,14 +388,21 @@ func ChangeSet(ctx context.Context, walker walk.Walker, filesCh chan<- *walk.Fil
 	var bucket *bolt.Bucket
 	var processed int
 
-	defer func() {
+	var p *pruner
+	if prune {
+		p = newPruner(walker.Root())
+	}
+
+	closeTx := func() {
 		// close any pending read tx
 		if tx != nil {
 			_ = tx.Rollback()
+			tx = nil
 		}
-	}()
+	}
+	defer closeTx()
 
-	return walker.Walk(ctx, func(file *walk.File, err error) error {
+	err := walker.Walk(ctx, func(file *walk.File, err error) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -233,9 +430,23 @@ func ChangeSet(ctx context.Context, walker walk.Walker, filesCh chan<- *walk.Fil
 			return err
 		}
 
-		changedOrNew := cached == nil || !(cached.Modified == file.Info.ModTime() && cached.Size == file.Info.Size())
+		changedOrNew := cached == nil || !(cached.Modified == file.Info.ModTime() && cached.Size == file.Info.Size()) ||
+			formattersChanged(file.RelPath, cached)
 
 		stats.Add(stats.Traversed, 1)
+
+		if p != nil {
+			p.see(file.RelPath)
+
+			if cached == nil {
+				renamed, err := p.renamed(bucket, file)
+				if err != nil {
+					return err
+				}
+				changedOrNew = !renamed
+			}
+		}
+
 		if !changedOrNew {
 			// no change
 			return nil
@@ -261,29 +472,90 @@ func ChangeSet(ctx context.Context, walker walk.Walker, filesCh chan<- *walk.Fil
 
 		return nil
 	})
+
+	// the read tx must be closed before writing, to avoid a deadlock
+	closeTx()
+
+	if err != nil || p == nil || readOnly {
+		return err
+	}
+
+	return p.apply()
 }
 
 // Update is used to record updated cache information for the specified list of paths.
+//
+// Entries record a content hash of their file for recognising it once it has been renamed. To limit the cost of
+// reading files again, a file is only hashed if recognising it would save formatting it: some formatter matches it and
+// none skip it for being too large. The hash in an existing entry is reused if the file's size and mod time are
+// unchanged, and any other files are hashed in parallel.
 func Update(files []*walk.File) error {
 	start := time.Now()
 	defer func() {
 		logger.Debugf("finished processing %v paths in %v", len(files), time.Since(start))
 	}()
 
-	if len(files) == 0 {
+	if len(files) == 0 || readOnly {
 		return nil
 	}
 
-	return db.Update(func(tx *bolt.Tx) error {
+	entries := make([]Entry, len(files))
+	for idx, f := range files {
+		entries[idx] = Entry{
+			Size:       f.Info.Size(),
+			Modified:   f.Info.ModTime(),
+			Formatters: matching(f.RelPath),
+		}
+	}
+
+	// reuse the hashes of files which are unchanged
+	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(pathsBucket))
 
-		for _, f := range files {
-			entry := Entry{
-				Size:     f.Info.Size(),
-				Modified: f.Info.ModTime(),
+		for idx, f := range files {
+			existing, err := getEntry(bucket, f.RelPath)
+			if err != nil {
+				return err
+			} else if existing != nil && existing.Size == entries[idx].Size &&
+				existing.Modified.Equal(entries[idx].Modified) {
+				entries[idx].Hash = existing.Hash
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// hash the remaining files outside a tx, so it is not held open whilst reading them
+	var eg errgroup.Group
+	eg.SetLimit(runtime.NumCPU())
+
+	for idx, f := range files {
+		if entries[idx].Hash != "" || !worthHashing(f) {
+			continue
+		}
+
+		eg.Go(func() error {
+			hash, err := format.HashFile(f.Path)
+			if err != nil {
+				// the entry is still useful, it just can't be used to recognise the file after it has been renamed
+				logger.Debugf("%v", err)
 			}
+			entries[idx].Hash = hash
+			return nil
+		})
+	}
+
+	// errors are only logged
+	_ = eg.Wait()
 
-			if err := putEntry(bucket, f.RelPath, &entry); err != nil {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pathsBucket))
+
+		for idx, f := range files {
+			if err := putEntry(bucket, f.RelPath, &entries[idx]); err != nil {
 				return err
 			}
 		}
@@ -291,3 +563,18 @@ func Update(files []*walk.File) error {
 		return nil
 	})
 }
+
+// worthHashing returns true if recognising file after it has been renamed would save formatting it again, as it is
+// matched by at least one formatter and is not too large for any of them.
+func worthHashing(file *walk.File) bool {
+	var matched bool
+	for _, formatter := range formatters {
+		if !formatter.Matches(file.RelPath) {
+			continue
+		} else if formatter.TooLarge(file) {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
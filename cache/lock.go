@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// ErrTreeLocked is returned when the tree lock could not be acquired within TreeLockTimeout.
+var ErrTreeLocked = errors.New("tree is being formatted by another invocation of treefmt")
+
+// TreeLockTimeout is how long to wait for another invocation of treefmt to finish formatting a tree.
+var TreeLockTimeout = 30 * time.Second
+
+// treeLockRetry is how often to retry acquiring the tree lock whilst it is held by another invocation.
+const treeLockRetry = 50 * time.Millisecond
+
+// LockPath returns the location of the advisory lock for treeRoot, next to its cache database. See Locate.
+func LockPath(treeRoot string, dir string) string {
+	path := Locate(treeRoot, dir)
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".lock"
+}
+
+// LockTree acquires an advisory lock on treeRoot, so that concurrent invocations of treefmt do not format the same
+// files at the same time. The lock is located next to the cache database in dir, or the default location if dir is
+// empty. If another invocation holds the lock, a warning is logged and LockTree waits up to TreeLockTimeout for it to
+// be released, after which ErrTreeLocked is returned. The returned function releases the lock.
+func LockTree(treeRoot string, dir string) (func() error, error) {
+	path := LockPath(treeRoot, dir)
+	if err := createDir(filepath.Dir(path), treeRoot); err != nil {
+		return nil, fmt.Errorf("could not create directory for the tree lock: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree lock %v: %w", path, err)
+	}
+
+	deadline := time.Now().Add(TreeLockTimeout)
+
+	for waiting := false; ; waiting = true {
+		locked, err := tryLock(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to lock tree %v: %w", treeRoot, err)
+		} else if locked {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			_ = file.Close()
+			return nil, fmt.Errorf("%w: gave up waiting after %v for %v", ErrTreeLocked, TreeLockTimeout, treeRoot)
+		} else if !waiting {
+			log.Warnf("waiting up to %v for another invocation of treefmt to finish formatting %v", TreeLockTimeout, treeRoot)
+		}
+
+		time.Sleep(treeLockRetry)
+	}
+
+	return func() error {
+		// closing the file releases the lock
+		return file.Close()
+	}, nil
+}
@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ExportVersion is the version of the format written by ExportTo.
+const ExportVersion = 1
+
+var (
+	// ErrNotFound is returned when managing a cache database which does not exist.
+	ErrNotFound = errors.New("cache not found")
+	// ErrInUse is returned when a cache database could not be locked within LockTimeout.
+	ErrInUse = errors.New("cache is in use by another invocation of treefmt")
+)
+
+// LockTimeout is how long to wait for another invocation of treefmt to release a cache database.
+var LockTimeout = time.Second
+
+// Info summarises the contents of a cache database.
+type Info struct {
+	// Path is the location of the database.
+	Path string
+	// Root is the tree root the database belongs to, if it has been recorded.
+	Root string
+	// Size is the size of the database in bytes.
+	Size int64
+	// Paths is the number of path entries.
+	Paths int
+	// Formatters are the formatter entries, by name.
+	Formatters map[string]*Entry
+}
+
+// Fingerprint returns the fingerprint of the named formatter, as recorded in the path entries it matched.
+func (i *Info) Fingerprint(name string) string {
+	entry, ok := i.Formatters[name]
+	if !ok {
+		return ""
+	}
+	return fingerprint(name, entry)
+}
+
+// Export is the portable representation of a cache database, written by ExportTo and read by ImportFrom.
+// Paths are relative to the tree root, so an export can be imported into a copy of the tree in another location.
+type Export struct {
+	Version    int               `json:"version"`
+	Formatters map[string]*Entry `json:"formatters"`
+	Paths      map[string]*Entry `json:"paths"`
+}
+
+// openDB opens the existing database at path for managing it.
+func openDB(path string, readOnly bool) (*bolt.DB, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w at %v", ErrNotFound, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat cache at %v: %w", path, err)
+	}
+	return openWithTimeout(path, readOnly)
+}
+
+// openWithTimeout opens the database at path, creating it if necessary, without waiting indefinitely for any other
+// invocation of treefmt which is using it.
+func openWithTimeout(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: readOnly, Timeout: LockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %v", ErrInUse, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open cache at %v: %w", path, err)
+	}
+
+	return db, nil
+}
+
+// forEach calls fn for each entry in the named bucket, which may not exist in older databases.
+func forEach(tx *bolt.Tx, bucket string, fn func(key string, entry *Entry) error) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(key []byte, _ []byte) error {
+		entry, err := getEntry(b, string(key))
+		if err != nil {
+			return err
+		}
+		return fn(string(key), entry)
+	})
+}
+
+// readRoot returns the tree root recorded in the database, or an empty string if it has not been recorded.
+func readRoot(tx *bolt.Tx) string {
+	if b := tx.Bucket([]byte(metaBucket)); b != nil {
+		return string(b.Get([]byte(rootKey)))
+	}
+	return ""
+}
+
+// ReadInfo summarises the cache database at path.
+func ReadInfo(path string) (*Info, error) {
+	db, err := openDB(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	info := Info{
+		Path:       path,
+		Formatters: make(map[string]*Entry),
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		info.Root = readRoot(tx)
+		info.Size = tx.Size()
+
+		if b := tx.Bucket([]byte(pathsBucket)); b != nil {
+			info.Paths = b.Stats().KeyN
+		}
+
+		return forEach(tx, formattersBucket, func(name string, entry *Entry) error {
+			info.Formatters[name] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache at %v: %w", path, err)
+	}
+
+	return &info, nil
+}
+
+// List calls fn for each path entry in the cache database at path, in lexical order of the path.
+func List(path string, fn func(relPath string, entry *Entry) error) error {
+	db, err := openDB(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		return forEach(tx, pathsBucket, fn)
+	})
+}
+
+// PrunePaths removes the entries for any files which no longer exist from the cache database at path, returning the
+// number of entries which were removed.
+func PrunePaths(path string, treeRoot string) (int, error) {
+	db, err := openDB(path, false)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var removed int
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pathsBucket))
+		if b == nil {
+			return nil
+		}
+
+		// collect the keys first, as deleting whilst iterating with a cursor can skip entries
+		var deleted [][]byte
+		if err := b.ForEach(func(key []byte, _ []byte) error {
+			if _, err := os.Lstat(filepath.Join(treeRoot, string(key))); errors.Is(err, fs.ErrNotExist) {
+				deleted = append(deleted, key)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range deleted {
+			if err := b.Delete(key); err != nil {
+				return fmt.Errorf("failed to remove path entry %s: %w", key, err)
+			}
+		}
+
+		removed = len(deleted)
+		return nil
+	})
+
+	return removed, err
+}
+
+// PruneTrees removes the cache databases of any trees which no longer exist, returning their tree roots.
+// Databases which are in use, or which do not record their tree root, are left alone.
+func PruneTrees() ([]string, error) {
+	entries, err := os.ReadDir(Dir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	var removed []string
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".db") {
+			continue
+		}
+
+		path := filepath.Join(Dir(), entry.Name())
+
+		info, err := ReadInfo(path)
+		if err != nil {
+			log.Warnf("skipping cache: %v", err)
+			continue
+		} else if info.Root == "" {
+			continue
+		}
+
+		if _, err = os.Stat(info.Root); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err = os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove cache at %v: %w", path, err)
+		}
+		removed = append(removed, info.Root)
+	}
+
+	return removed, nil
+}
+
+// ExportTo writes the contents of the cache database at path to w, in a portable format which can be read by
+// ImportFrom.
+func ExportTo(path string, w io.Writer) error {
+	db, err := openDB(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	export := Export{
+		Version:    ExportVersion,
+		Formatters: make(map[string]*Entry),
+		Paths:      make(map[string]*Entry),
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if err := forEach(tx, formattersBucket, func(name string, entry *Entry) error {
+			export.Formatters[name] = entry
+			return nil
+		}); err != nil {
+			return err
+		}
+		return forEach(tx, pathsBucket, func(relPath string, entry *Entry) error {
+			export.Paths[filepath.ToSlash(relPath)] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read cache at %v: %w", path, err)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	if err = encoder.Encode(export); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	return nil
+}
+
+// ImportFrom reads an export written by ExportTo from r into the cache database at path, replacing its contents.
+func ImportFrom(path string, treeRoot string, r io.Reader) error {
+	var export Export
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("failed to read export: %w", err)
+	} else if export.Version != ExportVersion {
+		return fmt.Errorf("unsupported export version %d, expected %d", export.Version, ExportVersion)
+	}
+
+	if err := createDir(filepath.Dir(path), treeRoot); err != nil {
+		return fmt.Errorf("could not create directory for the cache: %w", err)
+	}
+
+	db, err := openWithTimeout(path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{metaBucket, formattersBucket, pathsBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return fmt.Errorf("failed to clear %s bucket: %w", name, err)
+			}
+		}
+
+		meta, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return fmt.Errorf("failed to create meta bucket: %w", err)
+		} else if err = meta.Put([]byte(rootKey), []byte(treeRoot)); err != nil {
+			return fmt.Errorf("failed to record tree root: %w", err)
+		}
+
+		formatters, err := tx.CreateBucket([]byte(formattersBucket))
+		if err != nil {
+			return fmt.Errorf("failed to create formatters bucket: %w", err)
+		}
+		for name, entry := range export.Formatters {
+			if err = putEntry(formatters, name, entry); err != nil {
+				return err
+			}
+		}
+
+		paths, err := tx.CreateBucket([]byte(pathsBucket))
+		if err != nil {
+			return fmt.Errorf("failed to create paths bucket: %w", err)
+		}
+		for relPath, entry := range export.Paths {
+			if err = putEntry(paths, filepath.FromSlash(relPath), entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Clear removes the cache database at path, if it exists.
+func Clear(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove cache at %v: %w", path, err)
+	}
+	return nil
+}
+
+// ClearAll removes the cache databases of all trees.
+func ClearAll() error {
+	if err := os.RemoveAll(Dir()); err != nil {
+		return fmt.Errorf("failed to remove cache directory %v: %w", Dir(), err)
+	}
+	return nil
+}
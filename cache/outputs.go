@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/format"
+)
+
+// outputsVersion is mixed into every key, so the layout of the store can be changed without reusing stale outputs.
+const outputsVersion = "treefmt-outputs-v2"
+
+// Outputs is a content-addressed store of formatted outputs. It maps the content and extension of a file before
+// formatting, and the fingerprints of the sequence of formatters applied to it, to the content of the file afterwards.
+//
+// Keys do not depend on the directory of a file or the machine it was formatted on, so the directory backing the store
+// can be shared, for example by restoring it as a CI artifact. Each output is stored in its own file, named by its key.
+type Outputs struct {
+	dir string
+}
+
+// OpenOutputs returns an Outputs store backed by dir, creating it if necessary. If dir is within treeRoot, ignore files
+// are written into it so that it is neither committed nor walked.
+func OpenOutputs(dir string, treeRoot string) (*Outputs, error) {
+	if err := createDir(dir, treeRoot); err != nil {
+		return nil, fmt.Errorf("failed to create output cache directory: %w", err)
+	}
+	return &Outputs{dir: dir}, nil
+}
+
+// OutputKey returns the key for the output of applying formatters, in order, to input read from the file at relPath.
+// Formatters may treat files differently based on their extension, so it is part of the key.
+// An error is returned if a formatter cannot be fingerprinted, in which case its outputs must not be cached.
+func OutputKey(input []byte, relPath string, formatters []*format.Formatter) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(outputsVersion))
+	for _, formatter := range formatters {
+		fingerprint, err := formatter.Fingerprint()
+		if err != nil {
+			return "", fmt.Errorf("failed to fingerprint formatter %s: %w", formatter.Name(), err)
+		}
+		_, _ = fmt.Fprintf(h, "\n%s", fingerprint)
+	}
+
+	_, _ = fmt.Fprintf(h, "\next=%q", filepath.Ext(relPath))
+
+	digest := sha256.Sum256(input)
+	_, _ = fmt.Fprintf(h, "\n%x", digest)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// path returns the location of the output for key, spreading outputs across sub-directories by the first two
+// characters of their key.
+func (o *Outputs) path(key string) string {
+	return filepath.Join(o.dir, key[:2], key)
+}
+
+// Get returns the output stored under key, or false if there isn't one. The mod time of the output is updated, so
+// Prune can tell when it was last used.
+func (o *Outputs) Get(key string) ([]byte, bool, error) {
+	path := o.path(key)
+	output, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read cached output %v: %w", key, err)
+	}
+
+	// the store may be read-only, for example when restored from a CI artifact, in which case outputs are only pruned
+	// by when they were stored
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return output, true, nil
+}
+
+// Put stores output under key. Outputs are written to a temporary file first and renamed into place, so concurrent
+// readers, including other invocations sharing the store, never see a partial output.
+func (o *Outputs) Put(key string, output []byte) error {
+	path := o.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create output cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for cached output %v: %w", key, err)
+	}
+	defer func() {
+		// a no-op once the file has been renamed
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = tmp.Write(output); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write cached output %v: %w", key, err)
+	} else if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cached output %v: %w", key, err)
+	} else if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store cached output %v: %w", key, err)
+	}
+
+	return nil
+}
+
+// Prune removes outputs which have not been used for longer than maxAge, and then the least recently used outputs
+// until the store is no larger than maxSize bytes. Either limit is ignored if it is zero. It returns the number of
+// outputs removed and their total size.
+func (o *Outputs) Prune(maxAge time.Duration, maxSize int64) (int, int64, error) {
+	type output struct {
+		path     string
+		size     int64
+		modified time.Time
+	}
+
+	var outputs []output
+	var total int64
+
+	err := filepath.WalkDir(o.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		} else if filepath.Dir(path) == o.dir {
+			// outputs are always in a sub-directory, so these are the ignore files written by createDir
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		outputs = append(outputs, output{path: path, size: info.Size(), modified: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to read output cache %v: %w", o.dir, err)
+	}
+
+	// least recently used first
+	slices.SortFunc(outputs, func(a, b output) int {
+		return a.modified.Compare(b.modified)
+	})
+
+	var removed int
+	var freed int64
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, output := range outputs {
+		expired := maxAge > 0 && output.modified.Before(cutoff)
+		oversize := maxSize > 0 && total-freed > maxSize
+		if !(expired || oversize) {
+			break
+		}
+
+		if err := os.Remove(output.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, freed, fmt.Errorf("failed to remove cached output %v: %w", output.path, err)
+		}
+		removed++
+		freed += output.size
+	}
+
+	return removed, freed, nil
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"git.numtide.com/numtide/treefmt/format"
+	"git.numtide.com/numtide/treefmt/stats"
+	"git.numtide.com/numtide/treefmt/walk"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sizeAndModTime narrows down which entries a new file may have been renamed from, before confirming it by comparing
+// content hashes.
+type sizeAndModTime struct {
+	size     int64
+	modified int64
+}
+
+// pruner tracks the paths which are seen whilst walking the whole tree, so the entries for any other paths can be
+// removed afterwards. It also recognises new paths which have been renamed from paths which no longer exist.
+type pruner struct {
+	root string
+	seen map[string]struct{}
+
+	// the paths of all entries by their size and mod time, loaded the first time a new path is seen
+	candidates map[sizeAndModTime][]string
+	// entries which have been moved to a new path, by their new path
+	moved map[string]*Entry
+}
+
+func newPruner(root string) *pruner {
+	return &pruner{
+		root:  root,
+		seen:  make(map[string]struct{}),
+		moved: make(map[string]*Entry),
+	}
+}
+
+// see records that relPath exists.
+func (p *pruner) see(relPath string) {
+	p.seen[relPath] = struct{}{}
+}
+
+// loadCandidates indexes the paths of all entries in bucket by their size and mod time.
+func (p *pruner) loadCandidates(bucket *bolt.Bucket) error {
+	p.candidates = make(map[sizeAndModTime][]string)
+	return bucket.ForEach(func(key []byte, _ []byte) error {
+		entry, err := getEntry(bucket, string(key))
+		if err != nil {
+			return err
+		}
+		index := sizeAndModTime{entry.Size, entry.Modified.UnixNano()}
+		p.candidates[index] = append(p.candidates[index], string(key))
+		return nil
+	})
+}
+
+// renamed checks if a file which has no entry in bucket has been renamed from a path which no longer exists, with the
+// same size, mod time and content. If it has, and it is matched by the same formatters as before, the entry is moved to
+// the file's path and renamed returns true, as the file does not need formatting again.
+func (p *pruner) renamed(bucket *bolt.Bucket, file *walk.File) (bool, error) {
+	if p.candidates == nil {
+		if err := p.loadCandidates(bucket); err != nil {
+			return false, fmt.Errorf("failed to load cache entries for detecting renames: %w", err)
+		}
+	}
+
+	key := sizeAndModTime{file.Info.Size(), file.Info.ModTime().UnixNano()}
+
+	// only hashed if there is a candidate to compare it with
+	var hash string
+
+	for idx, oldPath := range p.candidates[key] {
+		if _, err := os.Lstat(filepath.Join(p.root, oldPath)); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		entry, err := getEntry(bucket, oldPath)
+		if err != nil {
+			return false, err
+		} else if entry == nil || entry.Hash == "" {
+			// without a content hash, a matching size and mod time is not enough to be sure it is the same file
+			continue
+		}
+
+		if hash == "" {
+			if hash, err = format.HashFile(file.Path); err != nil {
+				return false, err
+			}
+		}
+
+		if entry.Hash != hash {
+			continue
+		}
+
+		// each entry can only be renamed once
+		p.candidates[key] = slices.Delete(p.candidates[key], idx, idx+1)
+
+		logger.Debugf("%s has been renamed from %s", file.RelPath, oldPath)
+
+		if !slices.Equal(entry.Formatters, matching(file.RelPath)) {
+			return false, nil
+		}
+
+		stats.Add(stats.Renamed, 1)
+		p.moved[file.RelPath] = entry
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// apply removes the entries for paths which were not seen, and writes the entries which were moved.
+func (p *pruner) apply() error {
+	var pruned int
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pathsBucket))
+
+		// collect the keys first, as deleting whilst iterating with a cursor can skip entries
+		var deleted [][]byte
+		if err := bucket.ForEach(func(key []byte, _ []byte) error {
+			if _, ok := p.seen[string(key)]; !ok {
+				deleted = append(deleted, key)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range deleted {
+			if err := bucket.Delete(key); err != nil {
+				return fmt.Errorf("failed to remove path entry %s: %w", key, err)
+			}
+		}
+		pruned = len(deleted)
+
+		for relPath, entry := range p.moved {
+			if err := putEntry(bucket, relPath, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prune cache: %w", err)
+	}
+
+	logger.Debugf("pruned %d entries for paths which no longer exist", pruned)
+	return nil
+}
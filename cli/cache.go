@@ -0,0 +1,275 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/cache"
+	"git.numtide.com/numtide/treefmt/config"
+)
+
+// Cache is used to inspect and manage the evaluation cache, with `treefmt cache <command>`.
+type Cache struct {
+	*Tree `kong:"-"`
+
+	Info   CacheInfo   `cmd:"" help:"Show the location and size of the cache, how many paths it contains and the fingerprints of the formatters which were applied."`
+	Ls     CacheLs     `cmd:"" help:"List the paths in the cache, along with their size, modification time and the formatters which matched them."`
+	Prune  CachePrune  `cmd:"" help:"Remove the entries for files which no longer exist, and the caches of trees which no longer exist."`
+	Export CacheExport `cmd:"" help:"Write the cache in a portable JSON format, with paths relative to the tree root."`
+	Import CacheImport `cmd:"" help:"Replace the cache with one written by export."`
+	Clear  CacheClear  `cmd:"" help:"Remove the cache."`
+}
+
+// resolve returns the config file, if one was found, and the tree root.
+// The config file is only required if the tree root has not been specified.
+func (c *Cache) resolve() (string, string, error) {
+	configFile, treeRoot, err := resolveTreeRoot(c.ConfigFile, c.TreeRoot, c.TreeRootFile)
+	if err != nil {
+		if c.TreeRoot == "" {
+			return "", "", err
+		}
+		return "", c.TreeRoot, nil
+	}
+	return configFile, treeRoot, nil
+}
+
+// path returns the tree root, and the location of its cache.
+// The config file is only required if the tree root has not been specified, otherwise it is only read for cache_dir.
+func (c *Cache) path() (string, string, error) {
+	configFile, treeRoot, err := c.resolve()
+	if err != nil {
+		return "", "", err
+	}
+
+	dir, err := configuredDir(configFile, treeRoot, c.CacheDir, func(cfg *config.Config) string {
+		return cfg.Global.CacheDir
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return treeRoot, cache.Locate(treeRoot, dir), nil
+}
+
+// configuredDir returns the directory given by flag or, if it is empty, the directory selected from the config file by
+// get, resolved relative to treeRoot. The config file is only read if necessary.
+func configuredDir(configFile string, treeRoot string, flag string, get func(cfg *config.Config) string) (string, error) {
+	var configured string
+	if configFile != "" && flag == "" {
+		cfg, err := config.ReadFile(configFile, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to read config file %v: %w", configFile, err)
+		}
+		configured = get(cfg)
+	}
+	return resolveDir(flag, configured, treeRoot), nil
+}
+
+// sortedNames returns the names of the formatters in the cache, in lexical order.
+func sortedNames(info *cache.Info) []string {
+	names := make([]string, 0, len(info.Formatters))
+	for name := range info.Formatters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+type CacheInfo struct{}
+
+func (ci *CacheInfo) Run(c *Cache) error {
+	_, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	info, err := cache.ReadInfo(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("path: %s\n", info.Path)
+	fmt.Printf("tree root: %s\n", info.Root)
+	fmt.Printf("size: %d bytes\n", info.Size)
+	fmt.Printf("paths: %d\n", info.Paths)
+	fmt.Printf("formatters: %d\n", len(info.Formatters))
+
+	for _, name := range sortedNames(info) {
+		entry := info.Formatters[name]
+		fmt.Printf(
+			"  %s: fingerprint=%s size=%d modified=%s\n",
+			name, info.Fingerprint(name), entry.Size, entry.Modified.Format(time.RFC3339),
+		)
+	}
+
+	return nil
+}
+
+type CacheLs struct{}
+
+func (cl *CacheLs) Run(c *Cache) error {
+	_, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	info, err := cache.ReadInfo(path)
+	if err != nil {
+		return err
+	}
+
+	// map fingerprints back to the names of formatters
+	names := make(map[string]string)
+	for name := range info.Formatters {
+		names[info.Fingerprint(name)] = name
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED\tFORMATTERS")
+
+	err = cache.List(path, func(relPath string, entry *cache.Entry) error {
+		var formatters []string
+		for _, fp := range entry.Formatters {
+			if name, ok := names[fp]; ok {
+				formatters = append(formatters, name)
+			} else {
+				// the formatter has since changed or been removed
+				formatters = append(formatters, fp[:8])
+			}
+		}
+		slices.Sort(formatters)
+
+		_, err := fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", relPath, entry.Size, entry.Modified.Format(time.RFC3339), formatters)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+type CachePrune struct {
+	OutputCacheDir string        `type:"path" env:"TREEFMT_OUTPUT_CACHE_DIR" help:"The output cache to prune. Overrides output_cache_dir in the config."`
+	OutputsMaxAge  time.Duration `default:"720h" help:"Remove cached outputs which have not been used for longer than this, or 0 to keep them."`
+	OutputsMaxSize int64         `default:"0" help:"Remove the least recently used cached outputs until the output cache is no larger than this many bytes, or 0 for no limit."`
+}
+
+func (cp *CachePrune) Run(c *Cache) error {
+	treeRoot, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	removed, err := cache.PrunePaths(path, treeRoot)
+	if err != nil && !errors.Is(err, cache.ErrNotFound) {
+		return err
+	}
+	fmt.Printf("removed %d entries for files which no longer exist\n", removed)
+
+	if err = cp.pruneOutputs(c); err != nil {
+		return err
+	}
+
+	roots, err := cache.PruneTrees()
+	for _, root := range roots {
+		fmt.Printf("removed cache for %s\n", root)
+	}
+
+	return err
+}
+
+// pruneOutputs removes cached outputs from the output cache of the tree, if one is configured and exists.
+func (cp *CachePrune) pruneOutputs(c *Cache) error {
+	configFile, treeRoot, err := c.resolve()
+	if err != nil {
+		return err
+	}
+
+	dir, err := configuredDir(configFile, treeRoot, cp.OutputCacheDir, func(cfg *config.Config) string {
+		return cfg.Global.OutputCacheDir
+	})
+	if err != nil || dir == "" {
+		return err
+	} else if _, err = os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	outputs, err := cache.OpenOutputs(dir, treeRoot)
+	if err != nil {
+		return err
+	}
+
+	removed, freed, err := outputs.Prune(cp.OutputsMaxAge, cp.OutputsMaxSize)
+	fmt.Printf("removed %d cached outputs, freeing %d bytes\n", removed, freed)
+	return err
+}
+
+type CacheExport struct {
+	File string `arg:"" optional:"" help:"The file to write the export to (defaults to stdout)."`
+}
+
+func (ce *CacheExport) Run(c *Cache) error {
+	_, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if ce.File != "" && ce.File != "-" {
+		file, err := os.Create(ce.File)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", ce.File, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return cache.ExportTo(path, w)
+}
+
+type CacheImport struct {
+	File string `arg:"" optional:"" help:"The file to read the export from (defaults to stdin)."`
+}
+
+func (ci *CacheImport) Run(c *Cache) error {
+	treeRoot, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if ci.File != "" && ci.File != "-" {
+		file, err := os.Open(ci.File)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", ci.File, err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	return cache.ImportFrom(path, treeRoot, r)
+}
+
+type CacheClear struct {
+	All bool `help:"Remove the caches of all trees."`
+}
+
+func (cc *CacheClear) Run(c *Cache) error {
+	if cc.All {
+		return cache.ClearAll()
+	}
+
+	_, path, err := c.path()
+	if err != nil {
+		return err
+	}
+
+	return cache.Clear(path)
+}
@@ -0,0 +1,536 @@
+package cli
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/cache"
+	"git.numtide.com/numtide/treefmt/config"
+	"git.numtide.com/numtide/treefmt/stats"
+	"git.numtide.com/numtide/treefmt/test"
+	"github.com/adrg/xdg"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCacheCommands(t *testing.T) {
+	as := require.New(t)
+
+	// use a separate cache directory, so we can clear all caches
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	xdg.Reload()
+	t.Cleanup(xdg.Reload)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "touch.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	})
+
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+	cacheCmd := func(command ...string) (string, error) {
+		out, err := cmd(t, append(append([]string{"cache"}, command...), args...)...)
+		return string(out), err
+	}
+
+	// populate the cache
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+
+	out, err := cacheCmd("info")
+	as.NoError(err)
+	as.Contains(out, "path: "+cache.Path(tempDir))
+	as.Contains(out, "tree root: "+tempDir)
+	as.Contains(out, "paths: 32")
+	as.Contains(out, "formatters: 1")
+	as.Contains(out, "echo: fingerprint=")
+
+	out, err = cacheCmd("ls")
+	as.NoError(err)
+	as.Regexp(`go/main.go\s+\d+\s+\S+\s+\[echo\]`, out)
+	as.Regexp(`go/go.mod\s+\d+\s+\S+\s+\[\]`, out)
+
+	// entries for deleted files are pruned
+	as.NoError(os.Remove(filepath.Join(tempDir, "go", "main.go")))
+
+	out, err = cacheCmd("prune")
+	as.NoError(err)
+	as.Contains(out, "removed 1 entries for files which no longer exist")
+
+	out, err = cacheCmd("info")
+	as.NoError(err)
+	as.Contains(out, "paths: 31")
+
+	// export, clear and import the cache
+	exportPath := filepath.Join(t.TempDir(), "export.json")
+	_, err = cacheCmd("export", exportPath)
+	as.NoError(err)
+
+	_, err = cacheCmd("clear")
+	as.NoError(err)
+
+	_, err = cacheCmd("info")
+	as.ErrorIs(err, cache.ErrNotFound)
+
+	_, err = cacheCmd("import", exportPath)
+	as.NoError(err)
+
+	out, err = cacheCmd("info")
+	as.NoError(err)
+	as.Contains(out, "paths: 31")
+
+	// the imported cache is used when formatting
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 31, 0, 0, 0)
+
+	// the caches of trees which no longer exist are pruned
+	otherDir := test.TempExamples(t)
+	_, err = cmd(t, "--config-file", configPath, "--tree-root", otherDir)
+	as.NoError(err)
+	as.FileExists(cache.Path(otherDir))
+	as.NoError(os.RemoveAll(otherDir))
+
+	out, err = cacheCmd("prune")
+	as.NoError(err)
+	as.Contains(out, "removed cache for "+otherDir)
+	as.NoFileExists(cache.Path(otherDir))
+	as.FileExists(cache.Path(tempDir))
+
+	// all caches can be cleared
+	_, err = cacheCmd("clear", "--all")
+	as.NoError(err)
+	as.NoDirExists(cache.Dir())
+}
+
+func TestCachePruneOutputs(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "touch.toml")
+	outputsDir := filepath.Join(tempDir, ".treefmt-outputs")
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.py"},
+			},
+		},
+	}
+	cfg.Global.OutputCacheDir = ".treefmt-outputs"
+	test.WriteConfig(t, configPath, cfg)
+
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+
+	// the paths of the stored outputs, which are always in a sub-directory
+	outputs := func() []string {
+		var paths []string
+		as.NoError(filepath.WalkDir(outputsDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && filepath.Dir(path) != outputsDir {
+				paths = append(paths, path)
+			}
+			return err
+		}))
+		return paths
+	}
+
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	as.Len(outputs(), 2)
+
+	// outputs which have been used recently are kept
+	out, err := cmd(t, append([]string{"cache", "prune"}, args...)...)
+	as.NoError(err)
+	as.Contains(string(out), "removed 0 cached outputs")
+	as.Len(outputs(), 2)
+
+	// outputs which have not been used for longer than the max age are removed
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	as.NoError(os.Chtimes(outputs()[0], old, old))
+
+	out, err = cmd(t, append([]string{"cache", "prune"}, args...)...)
+	as.NoError(err)
+	as.Contains(string(out), "removed 1 cached outputs")
+	as.Len(outputs(), 1)
+
+	// as are the least recently used outputs, until the store is within the max size
+	out, err = cmd(t, append([]string{"cache", "prune", "--outputs-max-size", "1"}, args...)...)
+	as.NoError(err)
+	as.Contains(string(out), "removed 1 cached outputs")
+	as.Empty(outputs())
+
+	// the ignore files written into the output cache are kept
+	as.FileExists(filepath.Join(outputsDir, ".gitignore"))
+}
+
+func TestCacheCommandLine(t *testing.T) {
+	as := require.New(t)
+
+	// capture current cwd, so we can replace it after the test is finished
+	cwd, err := os.Getwd()
+	as.NoError(err)
+
+	t.Cleanup(func() {
+		as.NoError(os.Chdir(cwd))
+	})
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	xdg.Reload()
+	t.Cleanup(xdg.Reload)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	})
+
+	// a directory named cache, which can still be formatted
+	as.NoError(os.Mkdir(filepath.Join(tempDir, "cache"), 0o755))
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "cache", "main.go"), []byte("package main\n"), 0o644))
+
+	_, err = cmd(t, "-C", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 33, 33, 2, 0)
+
+	// flags which locate the tree can be given before or after the command
+	out, err := cmd(t, "-C", tempDir, "cache", "info")
+	as.NoError(err)
+	as.Contains(string(out), "tree root: "+tempDir)
+
+	out, err = cmd(t, "--tree-root", tempDir, "cache", "info")
+	as.NoError(err)
+	as.Contains(string(out), "tree root: "+tempDir)
+
+	out, err = cmd(t, "cache", "info", "--tree-root", tempDir)
+	as.NoError(err)
+	as.Contains(string(out), "tree root: "+tempDir)
+
+	// a path named cache is formatted by naming the format command, or with a relative path
+	_, err = cmd(t, "-C", tempDir, "-c", "format", "cache")
+	as.NoError(err)
+	assertStats(t, as, 1, 1, 1, 0)
+
+	_, err = cmd(t, "-C", tempDir, "-c", "./cache")
+	as.NoError(err)
+	assertStats(t, as, 1, 1, 1, 0)
+}
+
+func TestCachePruning(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go", "*.hs"},
+			},
+		},
+	})
+
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+
+	assertEntries := func(expected int) {
+		t.Helper()
+		info, err := cache.ReadInfo(cache.Path(tempDir))
+		as.NoError(err)
+		as.Equal(expected, info.Paths)
+	}
+
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 7, 0)
+	assertEntries(32)
+
+	// only files which are matched by a formatter are hashed for recognising renames
+	hashes := make(map[string]string)
+	as.NoError(cache.List(cache.Path(tempDir), func(relPath string, entry *cache.Entry) error {
+		hashes[relPath] = entry.Hash
+		return nil
+	}))
+	as.NotEmpty(hashes["haskell/Main.hs"])
+	as.Empty(hashes["go/go.mod"])
+
+	// the entries for deleted files are removed when walking the whole tree
+	as.NoError(os.Remove(filepath.Join(tempDir, "haskell", "Foo.hs")))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 31, 0, 0, 0)
+	assertEntries(31)
+
+	// but not when walking specific paths
+	as.NoError(os.Remove(filepath.Join(tempDir, "haskell", "Setup.hs")))
+
+	_, err = cmd(t, append(args, filepath.Join(tempDir, "haskell"))...)
+	as.NoError(err)
+	assertEntries(31)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 30, 0, 0, 0)
+	assertEntries(30)
+
+	// renamed files are recognised, and are not formatted again if they are matched by the same formatters
+	as.NoError(os.Rename(filepath.Join(tempDir, "haskell", "Main.hs"), filepath.Join(tempDir, "haskell", "Renamed.hs")))
+
+	out, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 30, 0, 0, 0)
+	as.Equal(int32(1), stats.Value(stats.Renamed))
+	as.Contains(string(out), "detected 1 renamed files")
+	assertEntries(30)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 30, 0, 0, 0)
+	as.Equal(int32(0), stats.Value(stats.Renamed))
+
+	// otherwise they are emitted
+	as.NoError(os.Rename(filepath.Join(tempDir, "go", "main.go"), filepath.Join(tempDir, "go", "main.txt")))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 30, 1, 0, 0)
+	as.Equal(int32(0), stats.Value(stats.Renamed))
+	assertEntries(30)
+
+	// a new file with the same size and mod time as a deleted file, but different content, is not a rename
+	renamedPath := filepath.Join(tempDir, "haskell", "Renamed.hs")
+	info, err := os.Stat(renamedPath)
+	as.NoError(err)
+	contents, err := os.ReadFile(renamedPath)
+	as.NoError(err)
+	as.NoError(os.Remove(renamedPath))
+
+	otherPath := filepath.Join(tempDir, "haskell", "Other.hs")
+	as.NoError(os.WriteFile(otherPath, bytes.Repeat([]byte("-"), len(contents)), 0o644))
+	as.NoError(os.Chtimes(otherPath, info.ModTime(), info.ModTime()))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 30, 1, 1, 0)
+	as.Equal(int32(0), stats.Value(stats.Renamed))
+	assertEntries(30)
+}
+
+func TestCacheDir(t *testing.T) {
+	as := require.New(t)
+
+	// use a separate cache directory, so we can check it is not used
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	xdg.Reload()
+	t.Cleanup(xdg.Reload)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "touch.toml")
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	}
+	cfg.Global.CacheDir = ".treefmt-cache"
+	test.WriteConfig(t, configPath, cfg)
+
+	_, err := cmd(t, "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+
+	// the cache is stored within the tree, and is not walked
+	as.FileExists(filepath.Join(tempDir, ".treefmt-cache", cache.DBName))
+	as.FileExists(filepath.Join(tempDir, ".treefmt-cache", ".gitignore"))
+	as.NoFileExists(cache.Path(tempDir))
+
+	_, err = cmd(t, "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	out, err := cmd(t, "cache", "info", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	as.Contains(string(out), "path: "+filepath.Join(tempDir, ".treefmt-cache", cache.DBName))
+
+	// the cache survives the tree being moved
+	movedDir := filepath.Join(t.TempDir(), "moved")
+	as.NoError(os.Rename(tempDir, movedDir))
+	configPath = filepath.Join(movedDir, "touch.toml")
+
+	_, err = cmd(t, "--config-file", configPath, "--tree-root", movedDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// the flag overrides the config
+	flagDir := filepath.Join(t.TempDir(), "cache")
+
+	_, err = cmd(t, "--config-file", configPath, "--tree-root", movedDir, "--cache-dir", flagDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+	as.FileExists(filepath.Join(flagDir, cache.DBName))
+
+	// ignore files are only written into directories within the tree
+	as.NoFileExists(filepath.Join(flagDir, ".gitignore"))
+	as.NoFileExists(filepath.Join(flagDir, ".treefmtignore"))
+}
+
+func TestCacheInUse(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "touch.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	})
+
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+
+	// populate the cache
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+
+	// formatting invocations are serialised by the tree lock, so the cache can only be held by cache commands
+	// when it is read, for example by listing its entries, the cache is consulted but not updated
+	touch := filepath.Join(tempDir, "go", "main.go")
+	as.NoError(os.Chtimes(touch, time.Now(), time.Now()))
+
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	listed := make(chan error, 1)
+	go func() {
+		var once sync.Once
+		listed <- cache.List(cache.Path(tempDir), func(string, *cache.Entry) error {
+			once.Do(func() {
+				close(listing)
+				<-release
+			})
+			return nil
+		})
+	}()
+	<-listing
+
+	out, err := cmd(t, args...)
+	close(release)
+	as.NoError(<-listed)
+	as.NoError(err)
+	as.Contains(string(out), "opening it read-only")
+	assertStats(t, as, 32, 1, 1, 0)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 1, 1, 0)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// when it is written, the cache is not used at all
+	db, err := bolt.Open(cache.Path(tempDir), 0o600, nil)
+	as.NoError(err)
+	out, err = cmd(t, args...)
+	as.NoError(db.Close())
+	as.NoError(err)
+	as.Contains(string(out), "failed to open cache")
+	assertStats(t, as, 32, 32, 1, 0)
+}
+
+func TestTreeLock(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "touch.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	})
+
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+
+	// simulate another invocation formatting the tree
+	unlock, err := cache.LockTree(tempDir, "")
+	as.NoError(err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cmd(t, args...)
+		done <- err
+	}()
+
+	// the invocation waits for the lock to be released
+	select {
+	case err = <-done:
+		as.Failf("invocation did not wait for the tree lock", "err: %v", err)
+	case <-time.After(time.Second):
+	}
+
+	as.NoError(unlock())
+	as.NoError(<-done)
+	assertStats(t, as, 32, 32, 1, 0)
+
+	// but gives up after the timeout, rather than formatting the tree at the same time as the other invocation
+	timeout := cache.TreeLockTimeout
+	cache.TreeLockTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		cache.TreeLockTimeout = timeout
+	})
+
+	unlock, err = cache.LockTree(tempDir, "")
+	as.NoError(err)
+
+	_, err = cmd(t, args...)
+	as.ErrorIs(err, cache.ErrTreeLocked)
+	as.NoError(unlock())
+
+	// invocations using a cache directory are locked next to it
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	unlock, err = cache.LockTree(tempDir, cacheDir)
+	as.NoError(err)
+	as.FileExists(filepath.Join(cacheDir, "eval-cache.lock"))
+
+	_, err = cmd(t, append(args, "--cache-dir", cacheDir)...)
+	as.ErrorIs(err, cache.ErrTreeLocked)
+	as.NoError(unlock())
+
+	// if the lock cannot be created, the tree is formatted without it
+	notDir := filepath.Join(t.TempDir(), "file")
+	as.NoError(os.WriteFile(notDir, nil, 0o644))
+
+	out, err := cmd(t, append(args, "--no-cache", "--cache-dir", filepath.Join(notDir, "cache"))...)
+	as.NoError(err)
+	as.Contains(string(out), "failed to lock tree")
+	assertStats(t, as, 32, 32, 1, 0)
+}
@@ -2,43 +2,96 @@ package cli
 
 import (
 	"os"
+	"sync"
+	"sync/atomic"
 
-	"github.com/gobwas/glob"
-
+	"git.numtide.com/numtide/treefmt/cache"
 	"git.numtide.com/numtide/treefmt/format"
 	"git.numtide.com/numtide/treefmt/walk"
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/log"
 )
 
-func New() *Format {
-	return &Format{}
+func New() *CLI {
+	c := &CLI{}
+	// the commands share the flags which locate the tree, so they may be given before the command
+	c.Format.Tree = &c.Tree
+	c.Cache.Tree = &c.Tree
+	return c
+}
+
+// CLI is the root of the command line. Formatting is the default command, so its flags and paths can be given without
+// naming it, whilst the cache is managed with `treefmt cache <command>`.
+type CLI struct {
+	Tree `embed:""`
+
+	Format Format `cmd:"" default:"withargs" help:"Format the tree, or the given paths. This is the default command."`
+	Cache  Cache  `cmd:"" help:"Inspect and manage the evaluation cache of the tree."`
+}
+
+// Tree holds the flags which locate the tree and its evaluation cache, shared by every command.
+type Tree struct {
+	WorkingDirectory kong.ChangeDirFlag `default:"." short:"C" help:"Run as if treefmt was started in the specified working directory instead of the current working directory."`
+	ConfigFile       string             `type:"existingfile" help:"Load the config file from the given path (defaults to searching upwards for treefmt.toml or .treefmt.toml)."`
+	TreeRoot         string             `type:"existingdir" xor:"tree-root" env:"PRJ_ROOT" help:"The root directory from which treefmt will start walking the filesystem (defaults to the directory containing the config file)."`
+	TreeRootFile     string             `type:"string" xor:"tree-root" help:"File to search for to find the project root (if --tree-root is not passed)."`
+	CacheDir         string             `type:"path" env:"TREEFMT_CACHE_DIR" help:"Store the cache in the given directory instead of the user's cache directory. Overrides cache_dir in the config."`
 }
 
 type Format struct {
-	AllowMissingFormatter bool               `default:"false" help:"Do not exit with error if a configured formatter is missing."`
-	WorkingDirectory      kong.ChangeDirFlag `default:"." short:"C" help:"Run as if treefmt was started in the specified working directory instead of the current working directory."`
-	NoCache               bool               `help:"Ignore the evaluation cache entirely. Useful for CI."`
-	ClearCache            bool               `short:"c" help:"Reset the evaluation cache. Use in case the cache is not precise enough."`
-	ConfigFile            string             `type:"existingfile" help:"Load the config file from the given path (defaults to searching upwards for treefmt.toml or .treefmt.toml)."`
-	FailOnChange          bool               `help:"Exit with error if any changes were made. Useful for CI."`
-	Formatters            []string           `short:"f" help:"Specify formatters to apply. Defaults to all formatters."`
-	TreeRoot              string             `type:"existingdir" xor:"tree-root" env:"PRJ_ROOT" help:"The root directory from which treefmt will start walking the filesystem (defaults to the directory containing the config file)."`
-	TreeRootFile          string             `type:"string" xor:"tree-root" help:"File to search for to find the project root (if --tree-root is not passed)."`
-	Walk                  walk.Type          `enum:"auto,git,filesystem" default:"auto" help:"The method used to traverse the files within --tree-root. Currently supports 'auto', 'git' or 'filesystem'."`
-	Verbosity             int                `name:"verbose" short:"v" type:"counter" default:"0" env:"LOG_LEVEL" help:"Set the verbosity of logs e.g. -vv."`
-	Version               bool               `name:"version" short:"V" help:"Print version."`
-	Init                  bool               `name:"init" short:"i" help:"Create a new treefmt.toml."`
+	*Tree `kong:"-"`
+
+	AllowMissingFormatter bool      `default:"false" help:"Do not exit with error if a configured formatter is missing."`
+	NoCache               bool      `help:"Ignore the evaluation cache entirely. Useful for CI."`
+	ClearCache            bool      `short:"c" help:"Reset the evaluation cache. Use in case the cache is not precise enough."`
+	OutputCacheDir        string    `type:"path" env:"TREEFMT_OUTPUT_CACHE_DIR" help:"Store formatted outputs by the content of their input in the given directory, and reuse them instead of running formatters. Overrides output_cache_dir in the config."`
+	FailOnChange          bool      `help:"Exit with error if any changes were made. Useful for CI."`
+	VerifyIdempotence     bool      `help:"Apply formatters a second time and exit with error if any files change again."`
+	Audit                 bool      `help:"Report any paths a formatter modifies, creates or deletes outside of the files it was given. Formatting is serialized whilst auditing."`
+	FailOnAudit           bool      `help:"Exit with error if --audit detects any paths affected outside of the files given to a formatter."`
+	Formatters            []string  `short:"f" help:"Specify formatters to apply. Defaults to all formatters."`
+	Walk                  walk.Type `enum:"auto,git,filesystem,command" default:"auto" help:"The method used to traverse the files within --tree-root. Currently supports 'auto', 'git', 'filesystem' or 'command'."`
+	NoGitignore           bool      `help:"Do not skip files ignored by .gitignore, .git/info/exclude or the global gitignore when walking the filesystem."`
+	NoUntracked           bool      `help:"Only format files in the git index when walking with git, skipping untracked files which are not ignored."`
+	RecurseSubmodules     bool      `help:"Format the files tracked by any initialised submodules when walking with git."`
+	SubmoduleConfig       bool      `help:"Format any initialised submodule containing its own treefmt.toml or .treefmt.toml as a separate tree, using its own config. Implies --recurse-submodules."`
+	Verbosity             int       `name:"verbose" short:"v" type:"counter" default:"0" env:"LOG_LEVEL" help:"Set the verbosity of logs e.g. -vv."`
+	Version               bool      `name:"version" short:"V" help:"Print version."`
+	Init                  bool      `name:"init" short:"i" help:"Create a new treefmt.toml."`
+
+	FormatterOutput log.Level `name:"formatter-output" default:"warn" help:"Log the output of formatters line by line at the specified log level. Possible values are <debug|info|warn|error>."`
+	LogDir          string    `type:"path" help:"Write a transcript of each batch processed by a formatter into a timestamped directory within the given directory, including the command line and exit status."`
 
 	OnUnmatched log.Level `name:"on-unmatched" short:"u" default:"warn" help:"Log paths that did not match any formatters at the specified log level, with fatal exiting the process with an error. Possible values are <debug|info|warn|error|fatal>."`
 
-	Paths []string `name:"paths" arg:"" type:"path" optional:"" help:"Paths to format. Defaults to formatting the whole tree."`
-	Stdin bool     `help:"Format the context passed in via stdin."`
+	Paths     []string `name:"paths" arg:"" type:"path" optional:"" help:"Paths to format. Defaults to formatting the whole tree."`
+	FilesFrom string   `name:"files-from" help:"Read additional paths to format from the given file, or stdin if '-', separated by newlines or NUL bytes. Paths which do not exist are skipped."`
+	Stdin     bool     `help:"Format the context passed in via stdin."`
 
 	CpuProfile string `optional:"" help:"The file into which a cpu profile will be written."`
 
 	formatters     map[string]*format.Formatter
-	globalExcludes []glob.Glob
+	globSyntax     format.GlobSyntax
+	globalExcludes format.Matcher
+	symlinks       walk.SymlinkPolicy
+	walkCommand    []string
+	ignoreFiles    []string
+
+	// submodules with their own config, which are formatted as separate trees once the tree has been formatted, and
+	// any paths given within each of them
+	submodules     []string
+	submodulePaths map[string][]string
+
+	// optional, a store of formatted outputs which can be reused instead of applying formatters
+	outputs *cache.Outputs
+
+	// number of files which changed when formatters were re-applied with --verify-idempotence
+	idempotenceViolations atomic.Int32
+
+	// serializes the formatting of batches when auditing, and counts the paths affected outside of a batch
+	auditor         *format.Auditor
+	auditLock       sync.Mutex
+	auditViolations atomic.Int32
 
 	filesCh     chan *walk.File
 	formattedCh chan *walk.File
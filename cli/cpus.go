@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystem is expected to be mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// availableCPUs returns the number of cpus which can be used for formatting, taking into account any cgroup cpu quota
+// which may have been applied e.g. when running in a container.
+func availableCPUs() int64 {
+	cpus := int64(runtime.NumCPU())
+	if quota, ok := cgroupCPUQuota(cgroupRoot); ok {
+		cpus = min(cpus, max(1, int64(math.Ceil(quota))))
+	}
+	return cpus
+}
+
+// cgroupCPUQuota returns the number of cpus allowed by the cgroup cpu quota beneath root, if any.
+// Both cgroup v2 (cpu.max) and cgroup v1 (cpu.cfs_quota_us and cpu.cfs_period_us) are supported.
+func cgroupCPUQuota(root string) (float64, bool) {
+	// cgroup v2 e.g. "max 100000" or "200000 100000"
+	if b, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return parseQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1, where a quota of -1 indicates no limit
+	quota, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return parseQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func parseQuota(quota string, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCgroupCPUQuota(t *testing.T) {
+	as := require.New(t)
+
+	write := func(path string, contents string) {
+		as.NoError(os.MkdirAll(filepath.Dir(path), 0o755))
+		as.NoError(os.WriteFile(path, []byte(contents), 0o644))
+	}
+
+	// no cgroup
+	_, ok := cgroupCPUQuota(t.TempDir())
+	as.False(ok)
+
+	// cgroup v2
+	v2 := t.TempDir()
+	write(filepath.Join(v2, "cpu.max"), "max 100000\n")
+	_, ok = cgroupCPUQuota(v2)
+	as.False(ok)
+
+	write(filepath.Join(v2, "cpu.max"), "250000 100000\n")
+	quota, ok := cgroupCPUQuota(v2)
+	as.True(ok)
+	as.Equal(2.5, quota)
+
+	// cgroup v1
+	v1 := t.TempDir()
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "-1\n")
+	write(filepath.Join(v1, "cpu", "cpu.cfs_period_us"), "100000\n")
+	_, ok = cgroupCPUQuota(v1)
+	as.False(ok)
+
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "50000\n")
+	quota, ok = cgroupCPUQuota(v1)
+	as.True(ok)
+	as.Equal(0.5, quota)
+}
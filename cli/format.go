@@ -1,15 +1,20 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,13 +27,24 @@ import (
 
 	"github.com/charmbracelet/log"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
 	BatchSize = 1024
 )
 
-var ErrFailOnChange = errors.New("unexpected changes detected, --fail-on-change is enabled")
+var (
+	ErrFailOnChange  = errors.New("unexpected changes detected, --fail-on-change is enabled")
+	ErrNotIdempotent = errors.New("formatters are not idempotent, --verify-idempotence is enabled")
+	ErrAuditFailed   = errors.New("formatters affected paths they were not given, --fail-on-audit is enabled")
+
+	// checkFailures are returned once formatting has completed, so they do not prevent submodules being formatted
+	checkFailures = []error{ErrFailOnChange, ErrAuditFailed, ErrNotIdempotent}
+)
+
+// configFileNames are searched for upwards from the working directory to find the config file.
+var configFileNames = []string{"treefmt.toml", ".treefmt.toml"}
 
 func (f *Format) Run() (err error) {
 	// set log level and other options
@@ -50,46 +66,36 @@ func (f *Format) Run() (err error) {
 		}()
 	}
 
+	// format the tree, followed by any submodules with their own config as separate trees, once the cache of the tree
+	// has been closed and its lock released
+	err = f.formatTree()
+	if err != nil && !isCheckFailure(err) {
+		return err
+	}
+
+	return f.formatSubmodules(err)
+}
+
+func (f *Format) formatTree() (err error) {
 	// create a prefixed logger
 	log.SetPrefix("format")
 
-	// ensure cache is closed on return
-	defer func() {
-		if err := cache.Close(); err != nil {
-			log.Errorf("failed to close cache: %v", err)
-		}
-	}()
-
-	// find the config file unless specified
-	if f.ConfigFile == "" {
-		pwd, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		f.ConfigFile, _, err = findUp(pwd, "treefmt.toml", ".treefmt.toml")
-		if err != nil {
-			return err
-		}
+	// find the config file and tree root
+	if f.ConfigFile, f.TreeRoot, err = resolveTreeRoot(f.ConfigFile, f.TreeRoot, f.TreeRootFile); err != nil {
+		return err
 	}
 
-	// default the tree root to the directory containing the config file
-	if f.TreeRoot == "" {
-		f.TreeRoot = filepath.Dir(f.ConfigFile)
-	}
+	log.Debugf("config-file=%s tree-root=%s", f.ConfigFile, f.TreeRoot)
 
-	// search the tree root using the --tree-root-file if specified
-	if f.TreeRootFile != "" {
-		pwd, err := os.Getwd()
-		if err != nil {
-			return err
-		}
-		_, f.TreeRoot, err = findUp(pwd, f.TreeRootFile)
-		if err != nil {
-			return err
-		}
+	// failing on audit implies auditing
+	if f.FailOnAudit {
+		f.Audit = true
 	}
 
-	log.Debugf("config-file=%s tree-root=%s", f.ConfigFile, f.TreeRoot)
+	// formatting submodules with their own config implies recursing into the others
+	if f.SubmoduleConfig {
+		f.RecurseSubmodules = true
+	}
 
 	// read config
 	cfg, err := config.ReadFile(f.ConfigFile, f.Formatters)
@@ -98,14 +104,54 @@ func (f *Format) Run() (err error) {
 	}
 
 	// compile global exclude globs
-	if f.globalExcludes, err = format.CompileGlobs(cfg.Global.Excludes); err != nil {
+	f.globSyntax = format.GlobSyntax(cfg.Global.GlobSyntax)
+	if f.globalExcludes, err = format.CompileMatcher(f.globSyntax, cfg.Global.Excludes); err != nil {
 		return fmt.Errorf("failed to compile global excludes: %w", err)
 	}
 
+	// determine how the tree should be walked
+	f.symlinks = walk.SymlinkPolicy(cfg.Global.Symlinks)
+	f.walkCommand = cfg.Global.WalkCommand
+	f.ignoreFiles = append([]string{walk.TreefmtIgnoreFile}, cfg.Global.IgnoreFiles...)
+
+	// find any submodules with their own config, which are skipped when walking and formatted separately afterwards
+	// this only applies when walking with git, and not when formatting stdin
+	f.submodules = nil
+	f.submodulePaths = make(map[string][]string)
+
+	usesGit := f.Walk == walk.Git || (f.Walk == walk.Auto && len(f.walkCommand) == 0)
+	if f.SubmoduleConfig && usesGit && !f.Stdin {
+		submodules, err := walk.ConfiguredSubmodules(f.TreeRoot, configFileNames)
+		if err != nil {
+			return fmt.Errorf("failed to find submodules with their own config: %w", err)
+		}
+		for _, submodule := range submodules {
+			f.submodules = append(f.submodules, filepath.Join(f.TreeRoot, submodule))
+		}
+	}
+
+	// configure how formatter output is reported
+	format.OutputLevel = f.FormatterOutput
+	format.LogDir = ""
+	if f.LogDir != "" {
+		// each run has its own directory, named by when it started and a random suffix, as runs may start in the same second
+		if err = os.MkdirAll(f.LogDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create log directory %s: %w", f.LogDir, err)
+		} else if format.LogDir, err = os.MkdirTemp(f.LogDir, time.Now().Format("20060102T150405")+"-*"); err != nil {
+			return fmt.Errorf("failed to create log directory for this run: %w", err)
+		}
+		log.Debugf("writing formatter transcripts to %s", format.LogDir)
+	}
+
 	// initialise formatters
 	f.formatters = make(map[string]*format.Formatter)
 
 	for name, formatterCfg := range cfg.Formatters {
+		// formatters which evaluate the global excludes before their own can re-include globally excluded paths
+		if f.inheritsExcludes(format.GlobSyntax(formatterCfg.GlobSyntax)) {
+			formatterCfg.Excludes = append(slices.Clone(cfg.Global.Excludes), formatterCfg.Excludes...)
+		}
+
 		formatter, err := format.NewFormatter(name, f.TreeRoot, formatterCfg)
 
 		if errors.Is(err, format.ErrCommandNotFound) && f.AllowMissingFormatter {
@@ -119,15 +165,77 @@ func (f *Format) Run() (err error) {
 		f.formatters[name] = formatter
 	}
 
+	// ensure formatters are closed on return, shutting down any persistent workers
+	defer func() {
+		for name, formatter := range f.formatters {
+			if err := formatter.Close(); err != nil {
+				log.Errorf("failed to close formatter %v: %v", name, err)
+			}
+		}
+	}()
+
+	// open the output cache if configured
+	outputCacheDir := resolveDir(f.OutputCacheDir, cfg.Global.OutputCacheDir, f.TreeRoot)
+
+	f.outputs = nil
+	if outputCacheDir != "" {
+		if f.outputs, err = cache.OpenOutputs(outputCacheDir, f.TreeRoot); err != nil {
+			// as with the cache, we log a warning and fallback to always applying formatters
+			log.Warnf("failed to open output cache: %v", err)
+		}
+	}
+
+	// resolve the cache directory, which the tree lock is located next to
+	cacheDir := resolveDir(f.CacheDir, cfg.Global.CacheDir, f.TreeRoot)
+
+	// prevent other invocations from formatting the tree at the same time
+	// this is unnecessary when formatting stdin, as it is copied to a temporary file
+	if !f.Stdin {
+		unlock, err := cache.LockTree(f.TreeRoot, cacheDir)
+		if errors.Is(err, cache.ErrTreeLocked) {
+			return err
+		} else if err != nil {
+			// as with the cache, we log a warning and fallback to formatting without the lock
+			log.Warnf("failed to lock tree: %v", err)
+		} else {
+			defer func() {
+				if err := unlock(); err != nil {
+					log.Errorf("failed to release tree lock: %v", err)
+				}
+			}()
+		}
+	}
+
+	// ensure cache is closed on return, before the tree lock is released
+	defer func() {
+		if err := cache.Close(); err != nil {
+			log.Errorf("failed to close cache: %v", err)
+		}
+	}()
+
 	// open the cache if configured
-	if !f.NoCache {
-		if err = cache.Open(f.TreeRoot, f.ClearCache, f.formatters); err != nil {
+	// it is not used when formatting stdin
+	if !f.NoCache && !f.Stdin {
+		if err = cache.Open(f.TreeRoot, cacheDir, f.ClearCache, f.formatters); err != nil {
 			// if we can't open the cache, we log a warning and fallback to no cache
 			log.Warnf("failed to open cache: %v", err)
 			f.NoCache = true
 		}
 	}
 
+	// audit the same paths as are walked, other than those written by treefmt itself
+	f.auditor = nil
+	if f.Audit {
+		ignorer, err := walk.NewIgnorer(f.TreeRoot, walk.Options{
+			NoGitignore: f.NoGitignore,
+			IgnoreFiles: f.ignoreFiles,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load ignore files for auditing: %w", err)
+		}
+		f.auditor = format.NewAuditor(f.TreeRoot, ignorer, cache.Dir(), cacheDir, outputCacheDir, f.LogDir)
+	}
+
 	// create an app context and listen for shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -167,6 +275,9 @@ func (f *Format) Run() (err error) {
 
 func (f *Format) walkFilesystem(ctx context.Context) func() error {
 	return func() error {
+		// close the files channel when we're done walking the file system
+		defer close(f.filesCh)
+
 		eg, ctx := errgroup.WithContext(ctx)
 		pathsCh := make(chan string, BatchSize)
 
@@ -177,6 +288,10 @@ func (f *Format) walkFilesystem(ctx context.Context) func() error {
 		if f.Stdin {
 			walkerType = walk.Filesystem
 
+			if f.FilesFrom != "" {
+				return fmt.Errorf("--files-from cannot be used with the --stdin flag")
+			}
+
 			// check we have only received one path arg which we use for the file extension / matching to formatters
 			if len(f.Paths) != 1 {
 				return fmt.Errorf("only one path should be specified when using the --stdin flag")
@@ -199,21 +314,55 @@ func (f *Format) walkFilesystem(ctx context.Context) func() error {
 		walkPaths := func() error {
 			defer close(pathsCh)
 
-			var idx int
-			for idx < len(f.Paths) {
+			// the same path may be given more than once, as a positional arg or in --files-from
+			seen := make(map[string]bool)
+
+			send := func(path string) error {
+				absPath, err := filepath.Abs(path)
+				if err != nil {
+					return fmt.Errorf("failed to resolve path %s: %w", path, err)
+				} else if seen[absPath] {
+					log.Debugf("path %v has already been given, skipping", absPath)
+					return nil
+				}
+				seen[absPath] = true
+
+				// paths within a submodule with its own config are formatted with that config afterwards, whilst a
+				// path containing such a submodule causes all of it to be formatted
+				for _, submodule := range f.submodules {
+					if isWithin(absPath, submodule) {
+						f.submodulePaths[submodule] = append(f.submodulePaths[submodule], absPath)
+						return nil
+					} else if isWithin(submodule, absPath) {
+						f.submodulePaths[submodule] = append(f.submodulePaths[submodule], submodule)
+					}
+				}
+
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				default:
-					pathsCh <- f.Paths[idx]
-					idx += 1
+				case pathsCh <- absPath:
+					return nil
+				}
+			}
+
+			for _, path := range f.Paths {
+				if err := send(path); err != nil {
+					return err
 				}
 			}
 
+			if f.FilesFrom != "" {
+				return f.readFilesFrom(send)
+			}
+
 			return nil
 		}
 
-		if len(f.Paths) > 0 {
+		// only prune the cache when walking the whole tree
+		wholeTree := len(f.Paths) == 0 && f.FilesFrom == ""
+
+		if !wholeTree {
 			eg.Go(walkPaths)
 		} else {
 			// no explicit paths to process, so we only need to process root
@@ -221,18 +370,30 @@ func (f *Format) walkFilesystem(ctx context.Context) func() error {
 			close(pathsCh)
 		}
 
+		// skip any submodules with their own config, which are formatted separately
+		var submoduleConfigFiles []string
+		if f.SubmoduleConfig {
+			submoduleConfigFiles = configFileNames
+		}
+
 		// create a filesystem walker
-		walker, err := walk.New(walkerType, f.TreeRoot, pathsCh)
+		walker, err := walk.New(walkerType, f.TreeRoot, pathsCh, walk.Options{
+			// when processing stdin, we are walking a temp file outside the tree
+			NoGitignore:          f.NoGitignore || f.Stdin,
+			NoUntracked:          f.NoUntracked,
+			RecurseSubmodules:    f.RecurseSubmodules,
+			SubmoduleConfigFiles: submoduleConfigFiles,
+			Symlinks:             f.symlinks,
+			Command:              f.walkCommand,
+			IgnoreFiles:          f.ignoreFiles,
+		})
 		if err != nil {
 			return fmt.Errorf("failed to create walker: %w", err)
 		}
 
-		// close the files channel when we're done walking the file system
-		defer close(f.filesCh)
-
 		// if no cache has been configured, or we are processing from stdin, we invoke the walker directly
 		if f.NoCache || f.Stdin {
-			return walker.Walk(ctx, func(file *walk.File, err error) error {
+			err = walker.Walk(ctx, func(file *walk.File, err error) error {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
@@ -243,15 +404,63 @@ func (f *Format) walkFilesystem(ctx context.Context) func() error {
 					return nil
 				}
 			})
+		} else if err = cache.ChangeSet(ctx, walker, f.filesCh, wholeTree); err != nil {
+			// otherwise we pass the walker to the cache and have it generate files for processing based on whether or
+			// not they have been added/changed since the last invocation
+			err = fmt.Errorf("failed to generate change set: %w", err)
+		}
+
+		if err != nil {
+			return err
 		}
 
-		// otherwise we pass the walker to the cache and have it generate files for processing based on whether or not
-		// they have been added/changed since the last invocation
-		if err = cache.ChangeSet(ctx, walker, f.filesCh); err != nil {
-			return fmt.Errorf("failed to generate change set: %w", err)
+		// report any errors encountered whilst reading paths
+		return eg.Wait()
+	}
+}
+
+// readFilesFrom reads paths from the file specified with --files-from, or stdin, passing each to send.
+// Relative paths are resolved against the working directory, and paths which do not exist are skipped.
+func (f *Format) readFilesFrom(send func(path string) error) error {
+	var r io.Reader = os.Stdin
+	if f.FilesFrom != "-" {
+		file, err := os.Open(f.FilesFrom)
+		if err != nil {
+			return fmt.Errorf("failed to open --files-from: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(walk.SplitPaths())
+
+	for scanner.Scan() {
+		path := scanner.Text()
+		if path == "" {
+			continue
+		}
+
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve path %s: %w", scanner.Text(), err)
+		}
+
+		if _, err = os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			log.Debugf("path %v does not exist, skipping", path)
+			continue
+		}
+
+		if err = send(path); err != nil {
+			return err
 		}
-		return nil
 	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read --files-from: %w", err)
+	}
+
+	return nil
 }
 
 // applyFormatters
@@ -259,19 +468,22 @@ func (f *Format) applyFormatters(ctx context.Context) func() error {
 	// create our own errgroup for concurrent formatting tasks.
 	// we don't want a cancel clause, in order to let formatters run up to the end.
 	fg := errgroup.Group{}
-	// simple optimization to avoid too many concurrent formatting tasks
+
+	// pace formatting tasks based on the number of cpus available to us and the number each batch requires
 	// we can queue them up faster than the formatters can process them, this paces things a bit
-	fg.SetLimit(runtime.NumCPU())
+	cpus := availableCPUs()
+	sem := semaphore.NewWeighted(cpus)
+	log.Debugf("scheduling formatters with a budget of %d cpu(s)", cpus)
 
 	// track batches of formatting task based on their batch keys, which are determined by the unique sequence of
 	// formatters which should be applied to their respective files
 	batches := make(map[string][]*format.Task)
 
-	apply := func(key string, flush bool) {
+	apply := func(key string, flush bool) error {
 		// lookup the batch and exit early if it's empty
 		batch := batches[key]
 		if len(batch) == 0 {
-			return
+			return nil
 		}
 
 		// process the batch if it's full, or we've been asked to flush partial batches
@@ -281,19 +493,28 @@ func (f *Format) applyFormatters(ctx context.Context) func() error {
 			tasks := make([]*format.Task, len(batch))
 			copy(tasks, batch)
 
+			// wait until there are enough cpus available for the batch
+			// a batch requires the most cpus of any formatter in its sequence, up to the total budget
+			weight := min(tasks[0].CPUs(), cpus)
+			if err := sem.Acquire(ctx, weight); err != nil {
+				return err
+			}
+
 			// asynchronously apply the sequence formatters to the batch
 			fg.Go(func() error {
-				// iterate the formatters, applying them in sequence to the batch of tasks
-				// we get the formatters list from the first task since they have all the same formatters list
-				for _, f := range tasks[0].Formatters {
-					if err := f.Apply(ctx, tasks); err != nil {
-						return err
-					}
+				defer sem.Release(weight)
+
+				if err := f.formatBatch(ctx, tasks); err != nil {
+					return err
 				}
 
-				// pass each file to the formatted channel
+				// pass each file to the formatted channel, unless we are shutting down and nothing is reading from it
 				for _, task := range tasks {
-					f.formattedCh <- task.File
+					select {
+					case f.formattedCh <- task.File:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
 				}
 
 				return nil
@@ -302,18 +523,25 @@ func (f *Format) applyFormatters(ctx context.Context) func() error {
 			// reset the batch
 			batches[key] = batch[:0]
 		}
+
+		return nil
 	}
 
-	tryApply := func(task *format.Task) {
+	tryApply := func(task *format.Task) error {
 		// append to batch
 		key := task.BatchKey
 		batches[key] = append(batches[key], task)
 		// try to apply
-		apply(key, false)
+		return apply(key, false)
 	}
 
-	return func() error {
+	return func() (err error) {
 		defer func() {
+			// wait for all outstanding formatting tasks to complete before closing the channel they write to, however
+			// we exit, preferring their error as returning early may only be a consequence of it
+			if fgErr := fg.Wait(); fgErr != nil {
+				err = fmt.Errorf("formatting failure: %w", fgErr)
+			}
 			// close processed channel
 			close(f.formattedCh)
 		}()
@@ -321,24 +549,62 @@ func (f *Format) applyFormatters(ctx context.Context) func() error {
 		// iterate the files channel
 		for file := range f.filesCh {
 
-			// first check if this file has been globally excluded
-			if format.PathMatches(file.RelPath, f.globalExcludes) {
-				log.Debugf("path matched global excludes: %s", file.RelPath)
-				// mark it as processed and continue to the next
-				f.formattedCh <- file
-				continue
-			}
+			// first check if this file has been globally excluded, in which case only formatters which evaluate the
+			// global excludes along with their own may re-include it
+			excluded := f.globalExcludes.Matches(file.RelPath)
 
-			// check if any formatters are interested in this file
+			// check if any formatters are interested in this file, and whether its size or content rules any of them out
 			var matches []*format.Formatter
+			var skipped bool
+
+			// only sniff the file's content once, and only if we need to
+			var binary *bool
+			isBinary := func() (bool, error) {
+				if binary == nil {
+					b, err := format.IsBinary(file.Path)
+					if err != nil {
+						return false, err
+					}
+					binary = &b
+				}
+				return *binary, nil
+			}
+
 			for _, formatter := range f.formatters {
-				if formatter.Wants(file) {
-					matches = append(matches, formatter)
+				if excluded && !f.inheritsExcludes(formatter.GlobSyntax()) {
+					continue
+				} else if !formatter.Wants(file) {
+					continue
+				}
+
+				reason, err := formatter.Skips(file, isBinary)
+				if err != nil {
+					return fmt.Errorf("failed to check if formatter %s should skip %s: %w", formatter.Name(), file.RelPath, err)
+				} else if reason != "" {
+					if f.OnUnmatched == log.FatalLevel {
+						return fmt.Errorf("formatter %s skipped path %s: %s", formatter.Name(), file.RelPath, reason)
+					}
+					log.Logf(f.OnUnmatched, "formatter %s skipped path %s: %s", formatter.Name(), file.RelPath, reason)
+					skipped = true
+					continue
 				}
+
+				matches = append(matches, formatter)
+			}
+
+			if skipped {
+				stats.Add(stats.Skipped, 1)
 			}
 
 			// see if any formatters matched
-			if len(matches) == 0 {
+			if len(matches) == 0 && excluded {
+				log.Debugf("path matched global excludes: %s", file.RelPath)
+				// mark it as processed and continue to the next
+				f.formattedCh <- file
+			} else if len(matches) == 0 && skipped {
+				// already reported, mark it as processed and continue to the next
+				f.formattedCh <- file
+			} else if len(matches) == 0 {
 				if f.OnUnmatched == log.FatalLevel {
 					return fmt.Errorf("no formatter for path: %s", file.RelPath)
 				}
@@ -350,21 +616,181 @@ func (f *Format) applyFormatters(ctx context.Context) func() error {
 				stats.Add(stats.Matched, 1)
 				// create a new format task, add it to a batch based on its batch key and try to apply if the batch is full
 				task := format.NewTask(file, matches)
-				tryApply(&task)
+				if err := tryApply(&task); err != nil {
+					return err
+				}
 			}
 		}
 
-		// flush any partial batches which remain
+		// flush any partial batches which remain, outstanding formatting tasks are waited for when we return
 		for key := range batches {
-			apply(key, true)
+			if err := apply(key, true); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// inheritsExcludes returns true if a formatter whose patterns use syntax evaluates the global excludes followed by its
+// own, in order. This is the case when both use gitignore syntax, so the last matching pattern takes precedence.
+func (f *Format) inheritsExcludes(syntax format.GlobSyntax) bool {
+	return f.globSyntax == format.GlobSyntaxGitignore && syntax == format.GlobSyntaxGitignore
+}
+
+// formatBatch applies the sequence of formatters to a batch of tasks.
+// Tasks whose output can be found in the output cache are not formatted, and the outputs of the rest are stored in it,
+// provided every formatter succeeds and, if verifying idempotence, no violations are found.
+func (f *Format) formatBatch(ctx context.Context, tasks []*format.Task) error {
+	// when auditing, batches must be processed one at a time so changes can be attributed to a formatter
+	// every file in the batch is expected to change, including those whose output is reused
+	batch := tasks
+	if f.Audit {
+		f.auditLock.Lock()
+		defer f.auditLock.Unlock()
+		defer f.auditor.Settle(batch)
+	}
+
+	var keys []string
+	if f.outputs != nil {
+		if tasks, keys = f.reuseOutputs(tasks); len(tasks) == 0 {
+			return nil
+		}
+	}
+
+	apply := func(ctx context.Context, formatter *format.Formatter, tasks []*format.Task) error {
+		return f.apply(ctx, formatter, tasks, batch)
+	}
+
+	// iterate the formatters, applying them in sequence to the batch of tasks
+	// we get the formatters list from the first task since they have all the same formatters list
+	formatters := tasks[0].Formatters
+
+	for _, formatter := range formatters {
+		if err := apply(ctx, formatter, tasks); err != nil {
+			return err
+		}
+	}
+
+	// optionally apply the formatters a second time, reporting any files which change again
+	if f.VerifyIdempotence {
+		violations, err := format.VerifyIdempotence(ctx, formatters, tasks, apply)
+		if err != nil {
+			return fmt.Errorf("failed to verify idempotence: %w", err)
+		}
+		for _, v := range violations {
+			log.Error(v.String())
+		}
+		f.idempotenceViolations.Add(int32(len(violations)))
+
+		// the outputs are not stable, so they should not be reused
+		if len(violations) > 0 {
+			return nil
+		}
+	}
+
+	// only store outputs once every formatter has been applied successfully
+	if f.outputs != nil {
+		f.storeOutputs(tasks, keys)
+	}
+
+	return nil
+}
+
+// reuseOutputs writes the cached output of any tasks which can be found in the output cache, returning the remaining
+// tasks along with the keys their outputs should be stored under once formatted.
+// The output cache is best-effort, so any errors are logged and the affected tasks formatted as normal.
+func (f *Format) reuseOutputs(tasks []*format.Task) ([]*format.Task, []string) {
+	var misses []*format.Task
+	var keys []string
+
+	for _, task := range tasks {
+		input, err := os.ReadFile(task.File.Path)
+		if err != nil {
+			log.Warnf("failed to read %s for the output cache: %v", task.File.Path, err)
+			misses = append(misses, task)
+			keys = append(keys, "")
+			continue
+		}
+
+		key, err := cache.OutputKey(input, task.File.RelPath, task.Formatters)
+		if err != nil {
+			log.Debugf("not using the output cache for %s: %v", task.File.RelPath, err)
+			misses = append(misses, task)
+			keys = append(keys, "")
+			continue
+		}
+
+		output, ok, err := f.outputs.Get(key)
+		if err != nil {
+			log.Warnf("failed to check the output cache for %s: %v", task.File.RelPath, err)
+		}
+
+		if !ok {
+			misses = append(misses, task)
+			keys = append(keys, key)
+			continue
+		}
+
+		// only write the file if it would change, to avoid needlessly changing its mod time
+		if !bytes.Equal(input, output) {
+			if err = os.WriteFile(task.File.Path, output, 0o644); err != nil {
+				log.Warnf("failed to write cached output to %s: %v", task.File.Path, err)
+				misses = append(misses, task)
+				keys = append(keys, key)
+				continue
+			}
+		}
+
+		log.Debugf("reused cached output for %s", task.File.RelPath)
+		stats.Add(stats.Reused, 1)
+	}
+
+	return misses, keys
+}
+
+// storeOutputs stores the outputs of formatted tasks in the output cache, under their corresponding keys.
+func (f *Format) storeOutputs(tasks []*format.Task, keys []string) {
+	for idx, task := range tasks {
+		if keys[idx] == "" {
+			continue
+		}
+
+		output, err := os.ReadFile(task.File.Path)
+		if err != nil {
+			log.Warnf("failed to read %s for the output cache: %v", task.File.Path, err)
+			continue
 		}
 
-		// wait for all outstanding formatting tasks to complete
-		if err := fg.Wait(); err != nil {
-			return fmt.Errorf("formatting failure: %w", err)
+		if err = f.outputs.Put(keys[idx], output); err != nil {
+			log.Warnf("failed to update the output cache for %s: %v", task.File.RelPath, err)
 		}
+	}
+}
+
+// apply applies a formatter to tasks, auditing the tree for changes outside the batch if configured.
+func (f *Format) apply(ctx context.Context, formatter *format.Formatter, tasks []*format.Task, batch []*format.Task) error {
+	if !f.Audit {
+		return formatter.Apply(ctx, tasks)
+	}
+
+	report, err := f.auditor.Apply(ctx, formatter, tasks, batch)
+	if err != nil {
+		return err
+	} else if report.Empty() {
 		return nil
 	}
+
+	f.auditViolations.Add(int32(report.Count()))
+
+	if f.FailOnAudit {
+		log.Error(report.String())
+	} else {
+		log.Warn(report.String())
+	}
+
+	return nil
 }
 
 func (f *Format) detectFormatted(ctx context.Context) func() error {
@@ -487,6 +913,16 @@ func (f *Format) updateCache(ctx context.Context) func() error {
 			return ErrFailOnChange
 		}
 
+		// if auditing has been enabled and we should fail, check that formatters only affected the paths they were given
+		if f.FailOnAudit && f.auditViolations.Load() != 0 {
+			return ErrAuditFailed
+		}
+
+		// if idempotence verification has been enabled, check that no files changed when formatters were re-applied
+		if f.VerifyIdempotence && f.idempotenceViolations.Load() != 0 {
+			return ErrNotIdempotent
+		}
+
 		// print stats to stdout unless we are processing stdin and printing the results to stdout
 		if !f.Stdin {
 			stats.Print()
@@ -496,6 +932,125 @@ func (f *Format) updateCache(ctx context.Context) func() error {
 	}
 }
 
+// formatSubmodules formats each submodule with its own config as a separate tree, with the same flags other than those
+// which locate the tree, its caches and formatters. When paths were given, only the submodules containing them are
+// formatted. failed is any check which failed when formatting the tree, such as --fail-on-change, which is returned
+// along with those which failed for the submodules.
+func (f *Format) formatSubmodules(failed error) error {
+	var failures []error
+	record := func(err error) {
+		for _, failure := range checkFailures {
+			if errors.Is(err, failure) && !slices.Contains(failures, failure) {
+				failures = append(failures, failure)
+			}
+		}
+	}
+	record(failed)
+
+	wholeTree := len(f.Paths) == 0 && f.FilesFrom == ""
+
+	for _, submodule := range f.submodules {
+		paths := f.submodulePaths[submodule]
+		if !wholeTree && len(paths) == 0 {
+			continue
+		}
+
+		configFile, _, err := findUp(submodule, configFileNames...)
+		if err != nil {
+			return fmt.Errorf("failed to find config file for submodule %v: %w", submodule, err)
+		}
+
+		log.Infof("formatting submodule %v with its own config", submodule)
+
+		sub := &Format{
+			Tree:                  &Tree{ConfigFile: configFile, TreeRoot: submodule},
+			AllowMissingFormatter: f.AllowMissingFormatter,
+			NoCache:               f.NoCache,
+			ClearCache:            f.ClearCache,
+			FailOnChange:          f.FailOnChange,
+			VerifyIdempotence:     f.VerifyIdempotence,
+			Audit:                 f.Audit,
+			FailOnAudit:           f.FailOnAudit,
+			Walk:                  f.Walk,
+			NoGitignore:           f.NoGitignore,
+			NoUntracked:           f.NoUntracked,
+			RecurseSubmodules:     f.RecurseSubmodules,
+			SubmoduleConfig:       f.SubmoduleConfig,
+			Verbosity:             f.Verbosity,
+			FormatterOutput:       f.FormatterOutput,
+			LogDir:                f.LogDir,
+			OnUnmatched:           f.OnUnmatched,
+			Paths:                 paths,
+		}
+
+		if err = sub.Run(); err != nil && !isCheckFailure(err) {
+			return fmt.Errorf("failed to format submodule %v: %w", submodule, err)
+		}
+		record(err)
+	}
+
+	return errors.Join(failures...)
+}
+
+// isCheckFailure returns true if err only reports checks which failed once formatting had completed.
+func isCheckFailure(err error) bool {
+	return slices.ContainsFunc(checkFailures, func(failure error) bool {
+		return errors.Is(err, failure)
+	})
+}
+
+// isWithin returns true if path is dir, or is within it.
+func isWithin(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveDir returns the directory given by a flag, or failing that, the directory given in the config, which is
+// relative to the tree root.
+func resolveDir(flag string, configured string, treeRoot string) string {
+	if flag != "" || configured == "" {
+		return flag
+	} else if filepath.IsAbs(configured) {
+		return configured
+	}
+	return filepath.Join(treeRoot, configured)
+}
+
+// resolveTreeRoot finds the config file unless specified, and determines the tree root, defaulting to the directory
+// containing the config file unless specified or found by searching upwards for treeRootFile.
+func resolveTreeRoot(configFile string, treeRoot string, treeRootFile string) (string, string, error) {
+	// find the config file unless specified
+	if configFile == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+		configFile, _, err = findUp(pwd, configFileNames...)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	// default the tree root to the directory containing the config file
+	if treeRoot == "" {
+		treeRoot = filepath.Dir(configFile)
+	}
+
+	// search the tree root using the --tree-root-file if specified
+	if treeRootFile != "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return "", "", err
+		}
+		_, treeRoot, err = findUp(pwd, treeRootFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return configFile, treeRoot, nil
+}
+
 func findUp(searchDir string, fileNames ...string) (path string, dir string, err error) {
 	for _, dir := range eachDir(searchDir) {
 		for _, f := range fileNames {
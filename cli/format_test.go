@@ -2,22 +2,29 @@ package cli
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"git.numtide.com/numtide/treefmt/cache"
 	"git.numtide.com/numtide/treefmt/config"
 	"git.numtide.com/numtide/treefmt/format"
+	"git.numtide.com/numtide/treefmt/stats"
 	"git.numtide.com/numtide/treefmt/test"
 
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/cache"
+	gitcache "github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
 	"github.com/go-git/go-git/v5/storage/filesystem"
 
 	"github.com/stretchr/testify/require"
@@ -138,6 +145,8 @@ func TestSpecifyingFormatters(t *testing.T) {
 				Command:  "touch",
 				Options:  []string{"-m"},
 				Includes: []string{"*.nix"},
+				// more than any machine will have, which should be limited to the available cpus
+				CPUs: 1024,
 			},
 			"ruby": {
 				Command:  "touch",
@@ -258,6 +267,60 @@ func TestIncludesAndExcludes(t *testing.T) {
 	assertStats(t, as, 32, 32, 2, 0)
 }
 
+func TestGlobalExcludesReinclusion(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"reinclude": {
+				Command:  "echo",
+				Includes: []string{"*.py"},
+				Excludes: []string{"!/python/main.py"},
+			},
+			"gitignore": {
+				Command:  "echo",
+				Includes: []string{"*.py"},
+			},
+			"default": {
+				Command:    "echo",
+				Includes:   []string{"*.py"},
+				GlobSyntax: "default",
+			},
+		},
+	}
+	cfg.Global.GlobSyntax = "gitignore"
+	cfg.Global.Excludes = []string{"*.py"}
+
+	test.WriteConfig(t, configPath, cfg)
+
+	// only the formatter which re-includes python/main.py is applied to it
+	out, err := cmd(t, "-vv", "--no-cache", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+	as.Contains(string(out), "formatter | reinclude: match: "+filepath.Join(tempDir, "python/main.py"))
+	as.NotContains(string(out), "formatter | gitignore: match")
+	as.NotContains(string(out), "formatter | default: match")
+
+	// without gitignore syntax, global excludes take precedence over a formatter's own
+	cfg.Global.GlobSyntax = "default"
+	cfg.Global.Excludes = []string{"*.py"}
+	cfg.Formatters = map[string]*config.Formatter{
+		"default": {
+			Command:  "echo",
+			Includes: []string{"*.py"},
+		},
+	}
+
+	test.WriteConfig(t, configPath, cfg)
+
+	_, err = cmd(t, "--no-cache", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 0, 0)
+}
+
 func TestCache(t *testing.T) {
 	as := require.New(t)
 
@@ -375,213 +438,1607 @@ func TestFailOnChange(t *testing.T) {
 	as.ErrorIs(err, ErrFailOnChange)
 }
 
-func TestBustCacheOnFormatterChange(t *testing.T) {
+func TestFormatterFailureWithQueuedBatches(t *testing.T) {
 	as := require.New(t)
 
 	tempDir := test.TempExamples(t)
-	configPath := tempDir + "/touch.toml"
+	configPath := tempDir + "/treefmt.toml"
 
-	// symlink some formatters into temp dir, so we can mess with their mod times
-	binPath := tempDir + "/bin"
-	as.NoError(os.Mkdir(binPath, 0o755))
+	// fill a batch for each formatter, so they are scheduled whilst we are still walking
+	for _, dir := range []string{"a", "b"} {
+		as.NoError(os.Mkdir(filepath.Join(tempDir, dir), 0o755))
+		for i := 0; i < BatchSize; i++ {
+			as.NoError(os.WriteFile(filepath.Join(tempDir, dir, fmt.Sprintf("%d.%s", i, dir)), nil, 0o644))
+		}
+	}
 
-	binaries := []string{"black", "elm-format", "gofmt"}
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"slow": {
+				Command:  "/bin/sh",
+				Options:  []string{"-c", "sleep 0.5", "--"},
+				Includes: []string{"*.a"},
+			},
+			"fail": {
+				Command:  "/bin/sh",
+				Options:  []string{"-c", "exit 1", "--"},
+				Includes: []string{"*.b"},
+			},
+		},
+	})
 
-	for _, name := range binaries {
-		src, err := exec.LookPath(name)
-		as.NoError(err)
-		as.NoError(os.Symlink(src, binPath+"/"+name))
-	}
+	// we stop scheduling at the first unmatched path, whilst the slow batch is still running
+	_, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--on-unmatched", "fatal")
+	as.ErrorContains(err, "formatting failure")
+	as.ErrorContains(err, "options '[-c exit 1 --]' failed to apply")
+}
 
-	// prepend our test bin directory to PATH
-	as.NoError(os.Setenv("PATH", binPath+":"+os.Getenv("PATH")))
+func TestVerifyIdempotence(t *testing.T) {
+	as := require.New(t)
 
-	// start with 2 formatters
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
+
+	// touch does not modify the contents of a file, so it is idempotent
 	cfg := config.Config{
 		Formatters: map[string]*config.Formatter{
-			"python": {
-				Command:  "black",
+			"touch": {
+				Command:  "touch",
 				Includes: []string{"*.py"},
 			},
-			"elm": {
-				Command:  "elm-format",
-				Options:  []string{"--yes"},
-				Includes: []string{"*.elm"},
-			},
 		},
 	}
 
 	test.WriteConfig(t, configPath, cfg)
-	args := []string{"--config-file", configPath, "--tree-root", tempDir}
-	_, err := cmd(t, args...)
+	_, err := cmd(t, "-c", "--verify-idempotence", "--config-file", configPath, "--tree-root", tempDir)
 	as.NoError(err)
-	assertStats(t, as, 32, 32, 3, 0)
+	assertStats(t, as, 32, 32, 2, 2)
 
-	// tweak mod time of elm formatter
-	as.NoError(test.RecreateSymlink(t, binPath+"/"+"elm-format"))
+	// appending to a file changes it every time it is applied
+	cfg.Formatters["append"] = &config.Formatter{
+		Command:  "/bin/sh",
+		Options:  []string{"-c", `for f; do echo "# appended" >> "$f"; done`, "--"},
+		Includes: []string{"*.py"},
+	}
 
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 32, 3, 0)
+	test.WriteConfig(t, configPath, cfg)
+	out, err := cmd(t, "-c", "--verify-idempotence", "--config-file", configPath, "--tree-root", tempDir)
+	as.ErrorIs(err, ErrNotIdempotent)
 
-	// check cache is working
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 0, 0, 0)
+	// the report names the offending formatter and includes the diff for each file
+	for _, path := range []string{"python/main.py", "python/virtualenv_proxy.py"} {
+		as.Contains(string(out), fmt.Sprintf("formatter 'append' is not idempotent for %s:", path))
+		as.Contains(string(out), fmt.Sprintf("--- a/%s\n+++ b/%s\n+# appended\n", path, path))
+	}
+	as.NotContains(string(out), "formatter 'touch' is not idempotent")
+}
 
-	// tweak mod time of python formatter
-	as.NoError(test.RecreateSymlink(t, binPath+"/"+"black"))
+func TestAudit(t *testing.T) {
+	as := require.New(t)
 
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 32, 3, 0)
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
 
-	// check cache is working
-	_, err = cmd(t, args...)
+	// touch only affects the files it is given
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"touch": {
+				Command:  "touch",
+				Includes: []string{"*.py"},
+			},
+		},
+	}
+
+	test.WriteConfig(t, configPath, cfg)
+	_, err := cmd(t, "-c", "--fail-on-audit", "--config-file", configPath, "--tree-root", tempDir)
 	as.NoError(err)
-	assertStats(t, as, 32, 0, 0, 0)
+	assertStats(t, as, 32, 32, 2, 2)
 
-	// add go formatter
-	cfg.Formatters["go"] = &config.Formatter{
-		Command:  "gofmt",
-		Options:  []string{"-w"},
-		Includes: []string{"*.go"},
+	// create a file outside the batch as a side effect
+	cfg.Formatters["stray"] = &config.Formatter{
+		Command:  "/bin/sh",
+		Options:  []string{"-c", `touch "$@" stray.txt`, "--"},
+		Includes: []string{"*.py"},
 	}
+
 	test.WriteConfig(t, configPath, cfg)
 
-	_, err = cmd(t, args...)
+	// by default, audit findings are only reported
+	_, err = cmd(t, "-c", "--audit", "--config-file", configPath, "--tree-root", tempDir)
 	as.NoError(err)
-	assertStats(t, as, 32, 32, 4, 0)
 
-	// check cache is working
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 0, 0, 0)
+	_, err = cmd(t, "-c", "--fail-on-audit", "--config-file", configPath, "--tree-root", tempDir)
+	as.ErrorIs(err, ErrAuditFailed)
+}
 
-	// remove python formatter
-	delete(cfg.Formatters, "python")
-	test.WriteConfig(t, configPath, cfg)
+func TestAuditIgnoredPaths(t *testing.T) {
+	as := require.New(t)
 
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 32, 2, 0)
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
 
-	// check cache is working
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 0, 0, 0)
+	// writes a file into a directory which is ignored when walking
+	as.NoError(os.WriteFile(filepath.Join(tempDir, ".treefmtignore"), []byte("build/\n"), 0o644))
 
-	// remove elm formatter
-	delete(cfg.Formatters, "elm")
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"build": {
+				Command:  "/bin/sh",
+				Options:  []string{"-c", `mkdir -p build && touch "$@" build/out.txt`, "--"},
+				Includes: []string{"*.py"},
+			},
+		},
+	}
+
+	// paths written by treefmt itself within the tree are not reported either
+	cfg.Global.CacheDir = ".treefmt-cache"
+	cfg.Global.OutputCacheDir = ".treefmt-outputs"
 	test.WriteConfig(t, configPath, cfg)
 
-	_, err = cmd(t, args...)
-	as.NoError(err)
-	assertStats(t, as, 32, 32, 1, 0)
+	logDir := filepath.Join(tempDir, "logs")
 
-	// check cache is working
-	_, err = cmd(t, args...)
+	_, err := cmd(t, "--fail-on-audit", "--verify-idempotence", "--log-dir", logDir,
+		"--config-file", configPath, "--tree-root", tempDir)
 	as.NoError(err)
-	assertStats(t, as, 32, 0, 0, 0)
+	as.DirExists(filepath.Join(tempDir, ".treefmt-outputs"))
+	as.DirExists(logDir)
 }
 
-func TestGitWorktree(t *testing.T) {
+func TestAuditIdempotence(t *testing.T) {
 	as := require.New(t)
 
 	tempDir := test.TempExamples(t)
-	configPath := filepath.Join(tempDir, "/treefmt.toml")
+	configPath := tempDir + "/touch.toml"
+
+	// creates a file outside the batch only when it is applied a second time
+	state := filepath.Join(t.TempDir(), "applied")
 
-	// basic config
 	cfg := config.Config{
 		Formatters: map[string]*config.Formatter{
-			"echo": {
-				Command:  "echo",
-				Includes: []string{"*"},
+			"second": {
+				Command: "/bin/sh",
+				Options: []string{
+					"-c", fmt.Sprintf(`touch "$@"; if [ -e %[1]s ]; then touch stray.txt; fi; touch %[1]s`, state), "--",
+				},
+				Includes: []string{"*.py"},
 			},
 		},
 	}
+
 	test.WriteConfig(t, configPath, cfg)
 
-	// init a git repo
-	repo, err := git.Init(
-		filesystem.NewStorage(
-			osfs.New(path.Join(tempDir, ".git")),
-			cache.NewObjectLRUDefault(),
-		),
-		osfs.New(tempDir),
-	)
-	as.NoError(err, "failed to init git repository")
+	_, err := cmd(t, "--fail-on-audit", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	as.NoError(os.Remove(state))
 
-	// get worktree
-	wt, err := repo.Worktree()
-	as.NoError(err, "failed to get git worktree")
+	// the second application when verifying idempotence is audited too
+	_, err = cmd(t, "-c", "--fail-on-audit", "--verify-idempotence", "--config-file", configPath, "--tree-root", tempDir)
+	as.ErrorIs(err, ErrAuditFailed)
+	as.FileExists(filepath.Join(tempDir, "stray.txt"))
+}
 
-	run := func(traversed int, emitted int, matched int, formatted int) {
-		out, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
-		as.NoError(err)
-		assertFormatted(t, as, out, formatted)
-	}
+func TestBuiltinFormatters(t *testing.T) {
+	as := require.New(t)
 
-	// run before adding anything to the worktree
-	run(0, 0, 0, 0)
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/treefmt.toml"
 
-	// add everything to the worktree
-	as.NoError(wt.AddGlob("."))
-	as.NoError(err)
-	run(32, 32, 32, 0)
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"go": {
+				Command:  "builtin:gofmt",
+				Includes: []string{"*.go"},
+			},
+			"json": {
+				Command:  "builtin:json",
+				Includes: []string{"*.json"},
+			},
+		},
+	})
 
-	// remove python directory
-	as.NoError(wt.RemoveGlob("python/*"))
-	run(28, 28, 28, 0)
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
 
-	// walk with filesystem instead of git
-	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem")
+	// main.go is already formatted, elm.json is indented with 4 spaces
+	_, err := cmd(t, args...)
 	as.NoError(err)
-	assertStats(t, as, 61, 61, 61, 0)
-}
+	assertStats(t, as, 32, 32, 2, 1)
 
-func TestPathsArg(t *testing.T) {
-	as := require.New(t)
+	contents, err := os.ReadFile(filepath.Join(tempDir, "elm/elm.json"))
+	as.NoError(err)
+	as.Contains(string(contents), "\n  \"type\": \"application\",\n")
 
-	// capture current cwd, so we can replace it after the test is finished
-	cwd, err := os.Getwd()
+	// builtins are cached like any other formatter
+	_, err = cmd(t, args...)
 	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
 
-	t.Cleanup(func() {
-		// return to the previous working directory
-		as.NoError(os.Chdir(cwd))
+	// unknown builtins are treated as missing formatters
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"foo": {
+				Command:  "builtin:foo",
+				Includes: []string{"*.foo"},
+			},
+		},
 	})
 
+	_, err = cmd(t, args...)
+	as.ErrorIs(err, format.ErrCommandNotFound)
+}
+
+func TestWasmFormatter(t *testing.T) {
+	as := require.New(t)
+
 	tempDir := test.TempExamples(t)
-	configPath := filepath.Join(tempDir, "/treefmt.toml")
+	configPath := tempDir + "/treefmt.toml"
+	wasmPath := filepath.Join(tempDir, "fmt.wasm")
 
-	// change working directory to temp root
-	as.NoError(os.Chdir(tempDir))
+	// compile a simple formatter which appends a line to each file it is given
+	src := `package main
 
-	// basic config
-	cfg := config.Config{
+import "os"
+
+func main() {
+	for _, path := range os.Args[2:] {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			panic(err)
+		}
+		if _, err = f.WriteString(os.Args[1] + "\n"); err != nil {
+			panic(err)
+		}
+		_ = f.Close()
+	}
+}
+`
+	buildGo(t, src, wasmPath, "GOOS=wasip1", "GOARCH=wasm")
+
+	test.WriteConfig(t, configPath, config.Config{
 		Formatters: map[string]*config.Formatter{
-			"echo": {
-				Command:  "echo",
-				Includes: []string{"*"},
+			"wasm": {
+				Wasm:     "fmt.wasm",
+				Options:  []string{"# formatted"},
+				Includes: []string{"*.py"},
 			},
 		},
-	}
-	test.WriteConfig(t, configPath, cfg)
+	})
 
-	// without any path args
-	_, err = cmd(t, "-C", tempDir)
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+
+	_, err := cmd(t, args...)
 	as.NoError(err)
-	assertStats(t, as, 32, 32, 32, 0)
+	assertStats(t, as, 33, 33, 2, 2)
 
-	// specify some explicit paths
-	_, err = cmd(t, "-C", tempDir, "-c", "elm/elm.json", "haskell/Nested/Foo.hs")
+	contents, err := os.ReadFile(filepath.Join(tempDir, "python/main.py"))
 	as.NoError(err)
-	assertStats(t, as, 2, 2, 2, 0)
+	as.True(strings.HasSuffix(string(contents), "# formatted\n"))
 
-	// specify a bad path
-	_, err = cmd(t, "-C", tempDir, "-c", "elm/elm.json", "haskell/Nested/Bar.hs")
-	as.ErrorContains(err, "no such file or directory")
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 33, 0, 0, 0)
+
+	hash := func() string {
+		t.Helper()
+		info, err := cache.ReadInfo(cache.Path(tempDir))
+		as.NoError(err)
+		as.Contains(info.Formatters, "wasm")
+		return info.Formatters["wasm"].Hash
+	}
+
+	moduleHash := func() string {
+		t.Helper()
+		contents, err := os.ReadFile(wasmPath)
+		as.NoError(err)
+		digest := sha256.Sum256(contents)
+		return hex.EncodeToString(digest[:])
+	}
+
+	before := hash()
+	as.Equal(moduleHash(), before)
+
+	// changing the code of the module invalidates the cache for the files it matches, the module itself is also emitted
+	changed := strings.Replace(src, "func main() {", "func main() {\n\tif os.Getenv(\"TREEFMT_WASM_TEST\") != \"\" {\n\t\tpanic(\"unexpected\")\n\t}", 1)
+	buildGo(t, changed, wasmPath, "GOOS=wasip1", "GOARCH=wasm")
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 33, 3, 2, 2)
+
+	// the content hash of the module is recorded, and differs from before
+	after := hash()
+	as.NotEqual(before, after)
+	as.Equal(moduleHash(), after)
+}
+
+func TestPersistentWorker(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/treefmt.toml"
+
+	// compile a worker which appends a line to each file it is given
+	binPath := t.TempDir()
+	buildGo(t, `package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+type request struct {
+	ID      int      `+"`json:\"id\"`"+`
+	Version int      `+"`json:\"version\"`"+`
+	Paths   []string `+"`json:\"paths\"`"+`
+}
+
+func main() {
+	if len(os.Args) != 3 || os.Args[2] != "--persistent-worker" {
+		os.Exit(1)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			panic(err)
+		}
+
+		for _, path := range req.Paths {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				panic(err)
+			}
+			_, _ = f.WriteString(os.Args[1] + "\n")
+			_ = f.Close()
+		}
+
+		if len(req.Paths) > 0 {
+			fmt.Fprintf(os.Stderr, "formatted %d path(s)\n", len(req.Paths))
+			// give treefmt time to copy stderr before the response completes the batch
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		_ = encoder.Encode(map[string]int{"id": req.ID, "version": req.Version})
+	}
+
+	// simulate a worker which does not exit when its stdin is closed
+	if os.Args[1] == "# hang" {
+		time.Sleep(time.Hour)
+	}
+}
+`, filepath.Join(binPath, "test-worker"))
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"worker": {
+				Command:  filepath.Join(binPath, "test-worker"),
+				Options:  []string{"# formatted"},
+				Worker:   true,
+				Includes: []string{"*.py"},
+			},
+		},
+	})
+
+	logDir := t.TempDir()
+
+	out, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--log-dir", logDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 2, 2)
+
+	contents, err := os.ReadFile(filepath.Join(tempDir, "python/main.py"))
+	as.NoError(err)
+	as.True(strings.HasSuffix(string(contents), "# formatted\n"))
+
+	// stderr is logged and recorded in transcripts in the same way as for executed formatters
+	as.Contains(string(out), "WARN formatter | worker: formatted 2 path(s)")
+
+	transcripts, err := filepath.Glob(filepath.Join(logDir, "*", "worker-*.log"))
+	as.NoError(err)
+	as.Len(transcripts, 1)
+
+	transcript, err := os.ReadFile(transcripts[0])
+	as.NoError(err)
+	as.Contains(string(transcript), "formatted 2 path(s)")
+
+	// workers which do not exit once their stdin is closed are killed
+	shutdownTimeout := format.WorkerShutdownTimeout
+	format.WorkerShutdownTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		format.WorkerShutdownTimeout = shutdownTimeout
+	})
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"worker": {
+				Command:  filepath.Join(binPath, "test-worker"),
+				Options:  []string{"# hang"},
+				Worker:   true,
+				Includes: []string{"*.py"},
+			},
+		},
+	})
+
+	out, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	as.Contains(string(out), "killed after not exiting within 100ms")
+
+	// we have second precision mod time tracking
+	time.Sleep(time.Second)
+
+	// formatters which don't support the protocol fall back to being executed for each batch
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"touch": {
+				Command:  "touch",
+				Worker:   true,
+				Includes: []string{"*.py"},
+			},
+		},
+	})
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 2, 2)
+}
+
+func TestFormatterOutput(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/treefmt.toml"
+	logDir := t.TempDir()
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"noisy": {
+				Command:  "/bin/sh",
+				Options:  []string{"-c", `echo "processing $# file(s)"; echo "a warning" >&2`, "--"},
+				Includes: []string{"*.py"},
+			},
+		},
+	})
+
+	// by default, output from successful formatters is logged at warn, so it is visible at the default verbosity
+	out, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	as.Contains(string(out), "WARN formatter | noisy: processing 2 file(s)")
+	as.Contains(string(out), "WARN formatter | noisy: a warning")
+
+	out, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--formatter-output", "info")
+	as.NoError(err)
+	as.NotContains(string(out), "a warning")
+
+	out, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--formatter-output", "info", "-v")
+	as.NoError(err)
+	as.Contains(string(out), "INFO formatter | noisy: processing 2 file(s)")
+	as.Contains(string(out), "INFO formatter | noisy: a warning")
+
+	// write transcripts
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--log-dir", logDir)
+	as.NoError(err)
+
+	transcripts, err := filepath.Glob(filepath.Join(logDir, "*", "noisy-*.log"))
+	as.NoError(err)
+	as.Len(transcripts, 1)
+
+	contents, err := os.ReadFile(transcripts[0])
+	as.NoError(err)
+	as.Contains(string(contents), "command: /bin/sh -c")
+	as.Contains(string(contents), "python/main.py")
+	as.Contains(string(contents), "processing 2 file(s)\na warning\n")
+	as.Contains(string(contents), "exit status: 0")
+
+	// runs within the same second are written to separate directories
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--log-dir", logDir)
+	as.NoError(err)
+
+	runs, err := filepath.Glob(filepath.Join(logDir, "*"))
+	as.NoError(err)
+	as.Len(runs, 2)
+}
+
+func TestBustCacheOnFormatterChange(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
+
+	// symlink some formatters into temp dir, so we can mess with their mod times
+	binPath := tempDir + "/bin"
+	as.NoError(os.Mkdir(binPath, 0o755))
+
+	binaries := []string{"black", "elm-format", "gofmt"}
+
+	for _, name := range binaries {
+		src, err := exec.LookPath(name)
+		as.NoError(err)
+		as.NoError(os.Symlink(src, binPath+"/"+name))
+	}
+
+	// prepend our test bin directory to PATH
+	as.NoError(os.Setenv("PATH", binPath+":"+os.Getenv("PATH")))
+
+	// start with 2 formatters
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"python": {
+				Command:  "black",
+				Includes: []string{"*.py"},
+			},
+			"elm": {
+				Command:  "elm-format",
+				Options:  []string{"--yes"},
+				Includes: []string{"*.elm"},
+			},
+		},
+	}
+
+	test.WriteConfig(t, configPath, cfg)
+	args := []string{"--config-file", configPath, "--tree-root", tempDir}
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 3, 0)
+
+	// tweak mod time of elm formatter, only the files it matches are emitted
+	as.NoError(test.RecreateSymlink(t, binPath+"/"+"elm-format"))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 1, 1, 0)
+
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// tweak mod time of python formatter
+	as.NoError(test.RecreateSymlink(t, binPath+"/"+"black"))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 2, 2, 0)
+
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// add go formatter
+	cfg.Formatters["go"] = &config.Formatter{
+		Command:  "gofmt",
+		Options:  []string{"-w"},
+		Includes: []string{"*.go"},
+	}
+	test.WriteConfig(t, configPath, cfg)
+
+	// the files it matches are emitted, along with the config file
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 2, 1, 0)
+
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// remove python formatter, the files it used to match are emitted
+	delete(cfg.Formatters, "python")
+	test.WriteConfig(t, configPath, cfg)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 3, 0, 0)
+
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+
+	// remove elm formatter
+	delete(cfg.Formatters, "elm")
+	test.WriteConfig(t, configPath, cfg)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 2, 0, 0)
+
+	// check cache is working
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 32, 0, 0, 0)
+}
+
+func TestBustCacheOnFormatterConfigChange(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := tempDir + "/touch.toml"
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.go"},
+			},
+		},
+	}
+
+	run := func(emitted int32, matched int32) {
+		t.Helper()
+		_, err := cmd(t, "--config-file", configPath, "--tree-root", tempDir)
+		as.NoError(err)
+		assertStats(t, as, 32, emitted, matched, 0)
+	}
+
+	test.WriteConfig(t, configPath, cfg)
+	run(32, 1)
+
+	// check cache is working
+	run(0, 0)
+
+	// only the files matched by a formatter are emitted when it changes, along with the config file itself
+	// change the options
+	cfg.Formatters["echo"].Options = []string{"-n"}
+	test.WriteConfig(t, configPath, cfg)
+	run(2, 1)
+	run(0, 0)
+
+	// change the includes
+	cfg.Formatters["echo"].Includes = []string{"*.go", "*.hs"}
+	test.WriteConfig(t, configPath, cfg)
+	run(8, 7)
+	run(0, 0)
+
+	// change the excludes, which emits the files the formatter used to match as well
+	cfg.Formatters["echo"].Excludes = []string{"haskell-frontend/*"}
+	test.WriteConfig(t, configPath, cfg)
+	run(8, 5)
+	run(0, 0)
+
+	// change the priority
+	cfg.Formatters["echo"].Priority = 1
+	test.WriteConfig(t, configPath, cfg)
+	run(6, 5)
+	run(0, 0)
+
+	// adding a formatter only emits the files it matches
+	cfg.Formatters["python"] = &config.Formatter{
+		Command:  "echo",
+		Includes: []string{"*.py"},
+	}
+	test.WriteConfig(t, configPath, cfg)
+	run(3, 2)
+	run(0, 0)
+
+	// removing a formatter only emits the files it used to match
+	delete(cfg.Formatters, "python")
+	test.WriteConfig(t, configPath, cfg)
+	run(3, 0)
+	run(0, 0)
+}
+
+func TestGitWorktree(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	// basic config
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	}
+	test.WriteConfig(t, configPath, cfg)
+
+	// init a git repo
+	repo, err := git.Init(
+		filesystem.NewStorage(
+			osfs.New(path.Join(tempDir, ".git")),
+			gitcache.NewObjectLRUDefault(),
+		),
+		osfs.New(tempDir),
+	)
+	as.NoError(err, "failed to init git repository")
+
+	// get worktree
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+
+	run := func(traversed int32, emitted int32, matched int32, formatted int32, args ...string) {
+		args = append([]string{"-c", "--config-file", configPath, "--tree-root", tempDir}, args...)
+		out, err := cmd(t, args...)
+		as.NoError(err)
+		assertFormatted(t, as, out, int(formatted))
+		assertStats(t, as, traversed, emitted, matched, formatted)
+	}
+
+	// run before adding anything to the worktree, which finds untracked files
+	run(32, 32, 32, 0)
+	run(0, 0, 0, 0, "--no-untracked")
+
+	// add everything to the worktree
+	as.NoError(wt.AddGlob("."))
+	as.NoError(err)
+	run(32, 32, 32, 0)
+	run(32, 32, 32, 0, "--no-untracked")
+
+	// create an untracked directory, which is walked unless it is ignored
+	untrackedDir := filepath.Join(tempDir, "untracked")
+	as.NoError(os.Mkdir(untrackedDir, 0o755))
+	for _, name := range []string{"a.txt", "b.txt"} {
+		as.NoError(os.WriteFile(filepath.Join(untrackedDir, name), []byte(name), 0o644))
+	}
+	run(34, 34, 34, 0)
+	run(32, 32, 32, 0, "--no-untracked")
+
+	// ignore the untracked directory, along with the haskell directory, which is tracked and so is still walked
+	// only the .gitignore file itself is found as an untracked file
+	as.NoError(os.WriteFile(filepath.Join(tempDir, ".gitignore"), []byte("haskell/\nuntracked/\n"), 0o644))
+	run(33, 33, 33, 0)
+	as.NoError(os.Remove(filepath.Join(tempDir, ".gitignore")))
+	as.NoError(os.RemoveAll(untrackedDir))
+
+	// remove python directory
+	as.NoError(wt.RemoveGlob("python/*"))
+	run(29, 29, 29, 0)
+
+	// walk with filesystem instead of git, which skips the .git directory
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem")
+	as.NoError(err)
+	assertStats(t, as, 29, 29, 29, 0)
+
+	// walk with filesystem and include everything
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem", "--no-gitignore")
+	as.NoError(err)
+	assertStats(t, as, 61, 61, 61, 0)
+}
+
+func TestGitExecutableFiles(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.sh"},
+			},
+		},
+	})
+
+	// shell/foo.sh is executable
+	info, err := os.Stat(filepath.Join(tempDir, "shell/foo.sh"))
+	as.NoError(err)
+	as.NotZero(info.Mode().Perm() & 0o111)
+
+	repo, err := git.Init(
+		filesystem.NewStorage(
+			osfs.New(path.Join(tempDir, ".git")),
+			gitcache.NewObjectLRUDefault(),
+		),
+		osfs.New(tempDir),
+	)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+
+	// whilst untracked, it is found by walking the filesystem
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+
+	// once tracked, git records it with an executable mode, which go-git does not consider to be regular, but it should
+	// still be walked
+	as.NoError(wt.AddGlob("."))
+
+	idx, err := repo.Storer.Index()
+	as.NoError(err)
+	entry, err := idx.Entry("shell/foo.sh")
+	as.NoError(err)
+	as.Equal(filemode.Executable, entry.Mode)
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 1, 0)
+}
+
+func TestGitSubmodules(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	})
+
+	// init a git repo and add everything to it
+	repo, err := git.PlainInit(tempDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	// init a submodule with some files, one of which is untracked
+	subDir := filepath.Join(tempDir, "lib", "sub")
+	as.NoError(os.MkdirAll(subDir, 0o755))
+
+	subRepo, err := git.PlainInit(subDir, false)
+	as.NoError(err, "failed to init submodule")
+
+	for _, name := range []string{"a.txt", "b.txt", "untracked.txt"} {
+		as.NoError(os.WriteFile(filepath.Join(subDir, name), []byte(name), 0o644))
+	}
+
+	subWt, err := subRepo.Worktree()
+	as.NoError(err, "failed to get submodule worktree")
+	_, err = subWt.Add("a.txt")
+	as.NoError(err)
+	_, err = subWt.Add("b.txt")
+	as.NoError(err)
+
+	// record the submodule as a gitlink in the superproject's index
+	idx, err := repo.Storer.Index()
+	as.NoError(err)
+	idx.Entries = append(idx.Entries, &index.Entry{Name: "lib/sub", Mode: filemode.Submodule})
+	as.NoError(repo.Storer.SetIndex(idx))
+
+	// by default, the submodule is skipped entirely
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 32, 0)
+
+	// files tracked by the submodule are included when recursing
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--recurse-submodules")
+	as.NoError(err)
+	assertStats(t, as, 34, 34, 34, 0)
+
+	// paths within a submodule are only walked when recursing
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, subDir)
+	as.NoError(err)
+	assertStats(t, as, 0, 0, 0, 0)
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--recurse-submodules", subDir)
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+
+	// give the submodule its own config, which only formats text files
+	test.WriteConfig(t, filepath.Join(subDir, "treefmt.toml"), config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*.txt"},
+			},
+		},
+	})
+
+	// when recursing, it is still walked as part of the superproject
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--recurse-submodules")
+	as.NoError(err)
+	assertStats(t, as, 34, 34, 34, 0)
+
+	// with --submodule-config, it is skipped and then formatted as a separate tree with its own config, including its
+	// untracked files, so the stats are those of the submodule
+	out, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--submodule-config")
+	as.NoError(err)
+	as.Contains(string(out), "traversed 32 files")
+	assertStats(t, as, 4, 4, 3, 0)
+
+	// paths within the submodule are only formatted with its own config
+	out, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--submodule-config",
+		filepath.Join(subDir, "a.txt"))
+	as.NoError(err)
+	as.Contains(string(out), "traversed 0 files")
+	assertStats(t, as, 1, 1, 1, 0)
+
+	// a path containing the submodule causes all of it to be formatted with its own config
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--submodule-config",
+		filepath.Join(tempDir, "lib"))
+	as.NoError(err)
+	assertStats(t, as, 4, 4, 3, 0)
+
+	// the submodule is not formatted when it does not contain any of the given paths
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--submodule-config",
+		filepath.Join(tempDir, "go"))
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+}
+
+func TestGitSparseCheckout(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	})
+
+	// init a git repo and add everything to it
+	repo, err := git.PlainInit(tempDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	// mark a file as skip-worktree and remove it
+	idx, err := repo.Storer.Index()
+	as.NoError(err)
+	entry, err := idx.Entry("python/main.py")
+	as.NoError(err)
+	entry.SkipWorktree = true
+	as.NoError(repo.Storer.SetIndex(idx))
+	as.NoError(os.Remove(filepath.Join(tempDir, "python/main.py")))
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 31, 31, 31, 0)
+
+	// exclude the haskell directory with sparse-checkout patterns and remove it
+	cfg, err := repo.Config()
+	as.NoError(err)
+	cfg.Raw.Section("core").SetOption("sparseCheckout", "true")
+	as.NoError(repo.SetConfig(cfg))
+
+	as.NoError(os.MkdirAll(filepath.Join(tempDir, ".git", "info"), 0o755))
+	as.NoError(os.WriteFile(
+		filepath.Join(tempDir, ".git", "info", "sparse-checkout"),
+		[]byte("/*\n!/haskell/\n"),
+		0o644,
+	))
+	as.NoError(os.RemoveAll(filepath.Join(tempDir, "haskell")))
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 24, 24, 24, 0)
+
+	// files removed from the worktree without being marked are skipped rather than failing the run
+	as.NoError(os.Remove(filepath.Join(tempDir, "go/main.go")))
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 23, 23, 23, 0)
+}
+
+func TestGitLinkedWorktree(t *testing.T) {
+	as := require.New(t)
+
+	mainDir := test.TempExamples(t)
+
+	// init a git repo and add everything to it
+	repo, err := git.PlainInit(mainDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	// ignore log files using the exclude file, which is shared with linked worktrees
+	as.NoError(os.MkdirAll(filepath.Join(mainDir, ".git", "info"), 0o755))
+	as.NoError(os.WriteFile(filepath.Join(mainDir, ".git", "info", "exclude"), []byte("*.log\n"), 0o644))
+
+	// create a linked worktree in the same way as `git worktree add`, with a copy of the index
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	})
+
+	linkedGitDir := filepath.Join(mainDir, ".git", "worktrees", "linked")
+	as.NoError(os.MkdirAll(linkedGitDir, 0o755))
+
+	index, err := os.ReadFile(filepath.Join(mainDir, ".git", "index"))
+	as.NoError(err)
+
+	for name, contents := range map[string]string{
+		"index":     string(index),
+		"commondir": "../..\n",
+		"HEAD":      "ref: refs/heads/linked\n",
+		"gitdir":    filepath.Join(tempDir, ".git") + "\n",
+	} {
+		as.NoError(os.WriteFile(filepath.Join(linkedGitDir, name), []byte(contents), 0o644))
+	}
+
+	as.NoError(os.WriteFile(filepath.Join(tempDir, ".git"), []byte("gitdir: "+linkedGitDir+"\n"), 0o644))
+
+	// add an untracked file which is ignored, and one which isn't
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "debug.log"), []byte("debug"), 0o644))
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("notes"), 0o644))
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "git")
+	as.NoError(err)
+	assertStats(t, as, 33, 33, 33, 0)
+
+	// the filesystem walker also respects the shared exclude file
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem")
+	as.NoError(err)
+	assertStats(t, as, 33, 33, 33, 0)
+}
+
+func TestSymlinks(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	}
+
+	// link to a file within the tree, and one outside of it
+	outsideFile := filepath.Join(t.TempDir(), "outside.txt")
+	as.NoError(os.WriteFile(outsideFile, []byte("outside"), 0o644))
+	as.NoError(os.Symlink("../yaml/test.yaml", filepath.Join(tempDir, "nix", "test.yaml")))
+	as.NoError(os.Symlink(outsideFile, filepath.Join(tempDir, "nix", "outside.txt")))
+
+	// init a git repo and add everything to it, including the symlinks
+	repo, err := git.PlainInit(tempDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	for _, walkType := range []string{"git", "filesystem"} {
+		// symlinks are skipped by default
+		test.WriteConfig(t, configPath, cfg)
+		_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", walkType)
+		as.NoError(err)
+		assertStats(t, as, 32, 32, 32, 0)
+
+		// the link within the tree resolves to a file which is only formatted once
+		cfg.Global.Symlinks = "target-in-tree"
+		test.WriteConfig(t, configPath, cfg)
+		_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", walkType)
+		as.NoError(err)
+		assertStats(t, as, 32, 32, 32, 0)
+
+		// the link outside the tree is followed as well
+		cfg.Global.Symlinks = "follow"
+		test.WriteConfig(t, configPath, cfg)
+		_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", walkType)
+		as.NoError(err)
+		assertStats(t, as, 33, 33, 33, 0)
+
+		cfg.Global.Symlinks = ""
+	}
+
+	// an unknown policy is an error
+	cfg.Global.Symlinks = "foo"
+	test.WriteConfig(t, configPath, cfg)
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.ErrorContains(err, "unknown symlink policy")
+}
+
+func TestWalkCommand(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	}
+	cfg.Global.WalkCommand = []string{"printf", `go/main.go\0yaml/test.yaml\0`}
+	test.WriteConfig(t, configPath, cfg)
+
+	// the configured command is used when detecting the walker
+	_, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "command")
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+
+	// unless another walker is selected
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem")
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 32, 0)
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	}
+
+	// track everything, to check ignore files apply to tracked files as well
+	repo, err := git.PlainInit(tempDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	writeIgnore := func(path string, contents string) {
+		as.NoError(os.WriteFile(filepath.Join(tempDir, path), []byte(contents), 0o644))
+	}
+
+	run := func(traversed int32, matched int32) {
+		for _, walkType := range []string{"git", "filesystem"} {
+			test.WriteConfig(t, configPath, cfg)
+			_, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", walkType)
+			as.NoError(err)
+			assertStats(t, as, traversed, traversed, matched, 0)
+		}
+	}
+
+	// .treefmtignore files are respected at any level
+	writeIgnore(".treefmtignore", "haskell/\n")
+	run(26, 26)
+
+	writeIgnore("rust/.treefmtignore", "*.toml\n")
+	run(26, 26)
+
+	// other ignore files are only respected when configured
+	writeIgnore(".prettierignore", "yaml/\n")
+	run(27, 27)
+
+	cfg.Global.IgnoreFiles = []string{".prettierignore"}
+	run(26, 26)
+
+	// formatters can have their own ignore files, which apply after walking
+	writeIgnore(".echoignore", "go/\n")
+	cfg.Formatters["echo"].IgnoreFiles = []string{".echoignore"}
+	run(27, 25)
+
+	// explicit paths which are ignored are skipped
+	_, err = cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, filepath.Join(tempDir, "haskell"))
+	as.NoError(err)
+	assertStats(t, as, 0, 0, 0, 0)
+}
+
+func TestSkipFiles(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	// a large file and a binary file, both of which look like yaml
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "yaml", "large.yaml"), []byte(strings.Repeat("a: b\n", 64*1024)), 0o644))
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "yaml", "binary.yaml"), []byte("a: \x00\x01\x02"), 0o644))
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+			"yaml": {
+				Command:  "echo",
+				Includes: []string{"*.yaml"},
+			},
+		},
+	}
+
+	run := func(matched int32, skipped int32, args ...string) {
+		test.WriteConfig(t, configPath, cfg)
+		args = append([]string{"-c", "--config-file", configPath, "--tree-root", tempDir}, args...)
+		out, err := cmd(t, args...)
+		as.NoError(err)
+		assertStats(t, as, 34, 34, matched, 0)
+		as.Equal(skipped, stats.Value(stats.Skipped))
+		if skipped > 0 {
+			as.Contains(string(out), fmt.Sprintf("skipped %d files", skipped))
+		}
+	}
+
+	run(34, 0)
+
+	// global settings apply to all formatters
+	cfg.Global.MaxFileSize = 64 * 1024
+	run(33, 1)
+
+	cfg.Global.SkipBinary = true
+	run(32, 2)
+
+	// formatters can override the global settings, including to disable them
+	maxFileSize, noLimit := int64(64*1024), int64(0)
+	skipBinary, noSkip := true, false
+
+	cfg.Formatters["yaml"].MaxFileSize = &noLimit
+	cfg.Formatters["yaml"].SkipBinary = &noSkip
+	run(34, 2)
+
+	// files are still formatted by formatters which don't skip them
+	cfg.Global.MaxFileSize = 0
+	cfg.Global.SkipBinary = false
+	cfg.Formatters["yaml"].MaxFileSize = &maxFileSize
+	cfg.Formatters["yaml"].SkipBinary = &skipBinary
+	run(34, 2)
+
+	// skipped files are reported at the on-unmatched level
+	test.WriteConfig(t, configPath, cfg)
+	_, err := cmd(t, "-c", "--config-file", configPath, "--tree-root", tempDir, "--on-unmatched", "fatal")
+	as.ErrorContains(err, "formatter yaml skipped path yaml/binary.yaml: binary or not valid UTF-8")
+}
+
+func TestOutputCache(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	// a formatter which upper cases files and appends a line, so we can tell if its output has been reused, and which
+	// records each time it is run
+	binDir := t.TempDir()
+	upper := filepath.Join(binDir, "upper")
+	runsPath := filepath.Join(binDir, "runs")
+	as.NoError(os.WriteFile(runsPath, nil, 0o644))
+
+	writeFormatter := func(suffix string) {
+		script := "#!/bin/sh\necho \"$@\" >> " + runsPath + "\n" +
+			"for f in \"$@\"; do case \"$f\" in -*) continue ;; esac; " +
+			"{ tr a-z A-Z < \"$f\"; echo done; } > \"$f.tmp\" && mv \"$f.tmp\" \"$f\"; done\n" + suffix
+		as.NoError(os.WriteFile(upper, []byte(script), 0o755))
+	}
+	writeFormatter("")
+
+	runs := func() int {
+		contents, err := os.ReadFile(runsPath)
+		as.NoError(err)
+		return strings.Count(string(contents), "\n")
+	}
+
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"upper": {
+				Command:  upper,
+				Includes: []string{"*.py", "*.pyi"},
+			},
+		},
+	}
+	cfg.Global.OutputCacheDir = ".treefmt-cache"
+
+	// remember the original contents of the files being formatted
+	paths, err := filepath.Glob(filepath.Join(tempDir, "python", "*.py"))
+	as.NoError(err)
+	as.NotEmpty(paths)
+
+	originals := make(map[string][]byte)
+	for _, path := range paths {
+		if originals[path], err = os.ReadFile(path); err != nil {
+			as.NoError(err)
+		}
+	}
+
+	restore := func() {
+		for path, contents := range originals {
+			as.NoError(os.WriteFile(path, contents, 0o644))
+		}
+	}
+
+	assertFormatted := func() {
+		for _, path := range paths {
+			contents, err := os.ReadFile(path)
+			as.NoError(err)
+			as.Equal(strings.ToUpper(string(originals[path]))+"done\n", string(contents))
+		}
+	}
+
+	test.WriteConfig(t, configPath, cfg)
+	args := []string{"--no-cache", "--config-file", configPath, "--tree-root", tempDir}
+
+	// the first run applies the formatter and stores its outputs
+	_, err = cmd(t, args...)
+	as.NoError(err)
+
+	traversed := stats.Value(stats.Traversed)
+	matched := int32(len(paths))
+
+	assertStats(t, as, traversed, traversed, matched, matched)
+	as.Equal(int32(0), stats.Value(stats.Reused))
+	as.Equal(1, runs())
+	assertFormatted()
+
+	// the formatter is not run when its outputs can be reused, and the cache directory is not walked
+	restore()
+
+	out, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, traversed, traversed, matched, matched)
+	as.Equal(matched, stats.Value(stats.Reused))
+	as.Contains(string(out), fmt.Sprintf("reused cached output for %d files", matched))
+	as.Equal(1, runs())
+	assertFormatted()
+
+	// a file with the same contents but a different extension does not reuse their outputs
+	restore()
+	stub := filepath.Join(tempDir, "python", "main.pyi")
+	as.NoError(os.WriteFile(stub, originals[filepath.Join(tempDir, "python", "main.py")], 0o644))
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	as.Equal(matched, stats.Value(stats.Reused))
+	as.Equal(2, runs())
+	as.NoError(os.Remove(stub))
+
+	// upgrading the formatter in place changes its fingerprint, so outputs are not reused
+	restore()
+	writeFormatter("# upgraded\n")
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	as.Equal(int32(0), stats.Value(stats.Reused))
+	as.Equal(3, runs())
+	assertFormatted()
+
+	// the outputs of a formatter which fails are not stored, even if it changed the files
+	writeFormatter("exit 1\n")
+
+	for i := 0; i < 2; i++ {
+		restore()
+		_, err = cmd(t, args...)
+		as.ErrorContains(err, "formatting failure")
+		as.Equal(int32(0), stats.Value(stats.Reused))
+	}
+	as.Equal(5, runs())
+
+	// changing the formatter's options changes its fingerprint, so outputs are not reused
+	restore()
+	writeFormatter("")
+	cfg.Formatters["upper"].Options = []string{"--verbose"}
+	test.WriteConfig(t, configPath, cfg)
+
+	_, err = cmd(t, args...)
+	as.NoError(err)
+	as.Equal(int32(0), stats.Value(stats.Reused))
+	as.Equal(6, runs())
+	assertFormatted()
+
+	// the contents of the formatter's config files are part of its fingerprint, whether or not they exist
+	cfg.Formatters["upper"].ConfigFiles = []string{"upper.conf"}
+	test.WriteConfig(t, configPath, cfg)
+
+	for _, contents := range []string{"", "first", "second"} {
+		if contents != "" {
+			as.NoError(os.WriteFile(filepath.Join(tempDir, "upper.conf"), []byte(contents), 0o644))
+		}
+
+		restore()
+		_, err = cmd(t, args...)
+		as.NoError(err)
+		as.Equal(int32(0), stats.Value(stats.Reused))
+
+		restore()
+		_, err = cmd(t, args...)
+		as.NoError(err)
+		as.Equal(matched, stats.Value(stats.Reused))
+	}
+	as.Equal(9, runs())
+}
+
+func TestFilesystemGitignore(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	})
+
+	// ignore a directory and some haskell files, with an exception, and a file via a nested .gitignore
+	gitignore := "haskell-frontend/\nhaskell/*.hs\n!haskell/Main.hs\n"
+	as.NoError(os.WriteFile(filepath.Join(tempDir, ".gitignore"), []byte(gitignore), 0o644))
+	as.NoError(os.WriteFile(filepath.Join(tempDir, "python", ".gitignore"), []byte("*.txt\n"), 0o644))
+
+	// exclude the rust directory via .git/info/exclude
+	as.NoError(os.MkdirAll(filepath.Join(tempDir, ".git", "info"), 0o755))
+	as.NoError(os.WriteFile(filepath.Join(tempDir, ".git", "info", "exclude"), []byte("/rust\n"), 0o644))
+
+	args := []string{"-c", "--config-file", configPath, "--tree-root", tempDir, "--walk", "filesystem"}
+
+	// 32 examples + 2 .gitignore files, less 6 haskell files, 2 rust files and python/requirements.txt
+	_, err := cmd(t, args...)
+	as.NoError(err)
+	assertStats(t, as, 25, 25, 25, 0)
+
+	// paths passed explicitly are also subject to ignore rules
+	paths := []string{"haskell", "haskell-frontend", "python"}
+	for i := range paths {
+		paths[i] = filepath.Join(tempDir, paths[i])
+	}
+	_, err = cmd(t, append(args, paths...)...)
+	as.NoError(err)
+	assertStats(t, as, 8, 8, 8, 0)
+
+	// include everything, including .git/info/exclude
+	_, err = cmd(t, append(args, "--no-gitignore")...)
+	as.NoError(err)
+	assertStats(t, as, 35, 35, 35, 0)
+}
+
+func TestPathsArg(t *testing.T) {
+	as := require.New(t)
+
+	// capture current cwd, so we can replace it after the test is finished
+	cwd, err := os.Getwd()
+	as.NoError(err)
+
+	t.Cleanup(func() {
+		// return to the previous working directory
+		as.NoError(os.Chdir(cwd))
+	})
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	// change working directory to temp root
+	as.NoError(os.Chdir(tempDir))
+
+	// basic config
+	cfg := config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	}
+	test.WriteConfig(t, configPath, cfg)
+
+	// without any path args
+	_, err = cmd(t, "-C", tempDir)
+	as.NoError(err)
+	assertStats(t, as, 32, 32, 32, 0)
+
+	// specify some explicit paths
+	_, err = cmd(t, "-C", tempDir, "-c", "elm/elm.json", "haskell/Nested/Foo.hs")
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+
+	// specify a bad path
+	_, err = cmd(t, "-C", tempDir, "-c", "elm/elm.json", "haskell/Nested/Bar.hs")
+	as.ErrorContains(err, "no such file or directory")
+}
+
+func TestFilesFrom(t *testing.T) {
+	as := require.New(t)
+
+	// capture current cwd and stdin, so we can replace them after the test is finished
+	cwd, err := os.Getwd()
+	as.NoError(err)
+
+	prevStdIn := os.Stdin
+
+	t.Cleanup(func() {
+		as.NoError(os.Chdir(cwd))
+		os.Stdin = prevStdIn
+	})
+
+	tempDir := test.TempExamples(t)
+	configPath := filepath.Join(tempDir, "/treefmt.toml")
+
+	// change working directory to temp root
+	as.NoError(os.Chdir(tempDir))
+
+	test.WriteConfig(t, configPath, config.Config{
+		Formatters: map[string]*config.Formatter{
+			"echo": {
+				Command:  "echo",
+				Includes: []string{"*"},
+			},
+		},
+	})
+
+	// init a git repo so we can walk multiple paths with git as well as the filesystem
+	repo, err := git.PlainInit(tempDir, false)
+	as.NoError(err, "failed to init git repository")
+
+	wt, err := repo.Worktree()
+	as.NoError(err, "failed to get git worktree")
+	as.NoError(wt.AddGlob("."))
+
+	// NUL separated, with absolute paths and a path which does not exist
+	nulList := filepath.Join(tempDir, "nul.list")
+	as.NoError(os.WriteFile(nulList, []byte(
+		filepath.Join(tempDir, "elm/elm.json")+"\x00"+
+			filepath.Join(tempDir, "haskell/Nested/Foo.hs")+"\x00"+
+			filepath.Join(tempDir, "haskell/Nested/Bar.hs")+"\x00",
+	), 0o644))
+
+	// newline separated, with relative paths and a directory
+	newlineList := filepath.Join(tempDir, "newline.list")
+	as.NoError(os.WriteFile(newlineList, []byte("go/main.go\nrust\n"), 0o644))
+
+	// the same paths, more than once
+	duplicatesList := filepath.Join(tempDir, "duplicates.list")
+	as.NoError(os.WriteFile(duplicatesList, []byte(
+		"go/main.go\nrust\n"+filepath.Join(tempDir, "go/main.go")+"\nrust/\n",
+	), 0o644))
+
+	for _, walkType := range []string{"git", "filesystem"} {
+		_, err = cmd(t, "-C", tempDir, "-c", "--walk", walkType, "--files-from", nulList)
+		as.NoError(err)
+		assertStats(t, as, 2, 2, 2, 0)
+
+		_, err = cmd(t, "-C", tempDir, "-c", "--walk", walkType, "--files-from", newlineList)
+		as.NoError(err)
+		assertStats(t, as, 3, 3, 3, 0)
+
+		// combined with positional paths
+		_, err = cmd(t, "-C", tempDir, "-c", "--walk", walkType, "--files-from", newlineList, "yaml")
+		as.NoError(err)
+		assertStats(t, as, 4, 4, 4, 0)
+
+		// paths given more than once, in either or both, are only walked once
+		_, err = cmd(t, "-C", tempDir, "-c", "--walk", walkType, "--files-from", newlineList, "go/main.go", "./rust")
+		as.NoError(err)
+		assertStats(t, as, 3, 3, 3, 0)
+
+		_, err = cmd(t, "-C", tempDir, "-c", "--walk", walkType, "--files-from", duplicatesList)
+		as.NoError(err)
+		assertStats(t, as, 3, 3, 3, 0)
+	}
+
+	// read from stdin
+	contents := "elm/elm.json\nnix/sources.nix\n"
+	os.Stdin = test.TempFile(t, "", "stdin", &contents)
+
+	_, err = cmd(t, "-C", tempDir, "-c", "--files-from", "-")
+	as.NoError(err)
+	assertStats(t, as, 2, 2, 2, 0)
+
+	// a missing list is an error
+	_, err = cmd(t, "-C", tempDir, "-c", "--files-from", filepath.Join(tempDir, "missing.list"))
+	as.ErrorContains(err, "failed to open --files-from")
 }
 
 func TestStdIn(t *testing.T) {
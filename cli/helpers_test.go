@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
 	"github.com/charmbracelet/log"
@@ -53,10 +55,15 @@ func cmd(t *testing.T, args ...string) ([]byte, error) {
 
 	log.SetOutput(tempOut)
 
-	// run the command
-	if err = ctx.Run(); err != nil {
-		return nil, err
-	}
+	// swap outputs back once we're done
+	defer func() {
+		os.Stdout = stdout
+		os.Stderr = stderr
+		log.SetOutput(stderr)
+	}()
+
+	// run the command, returning its output along with any error so that failures can be inspected
+	runErr := ctx.Run()
 
 	// reset and read the temporary output
 	if _, err = tempOut.Seek(0, 0); err != nil {
@@ -68,12 +75,7 @@ func cmd(t *testing.T, args ...string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read temp output: %w", err)
 	}
 
-	// swap outputs back
-	os.Stdout = stdout
-	os.Stderr = stderr
-	log.SetOutput(stderr)
-
-	return out, nil
+	return out, runErr
 }
 
 func assertStats(t *testing.T, as *require.Assertions, traversed int32, emitted int32, matched int32, formatted int32) {
@@ -88,3 +90,23 @@ func assertFormatted(t *testing.T, as *require.Assertions, output []byte, count
 	t.Helper()
 	as.Contains(string(output), fmt.Sprintf("(%d changed)", count))
 }
+
+// buildGo compiles a single file Go program from src into the output path, skipping the test if go is not available.
+func buildGo(t *testing.T, src string, output string, env ...string) {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is required to compile test programs")
+	}
+
+	srcDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "main.go"), []byte(src), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "go.mod"), []byte("module testprog\n"), 0o644))
+
+	build := exec.Command(goBin, "build", "-o", output, ".")
+	build.Dir = srcDir
+	build.Env = append(os.Environ(), env...)
+	out, err := build.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
@@ -11,6 +11,27 @@ type Config struct {
 	Global struct {
 		// Excludes is an optional list of glob patterns used to exclude certain files from all formatters.
 		Excludes []string `toml:"excludes"`
+		// GlobSyntax determines how include and exclude patterns are interpreted, either "default" or "gitignore".
+		// It applies to Excludes and to any Formatter which does not specify its own.
+		GlobSyntax string `toml:"glob_syntax,omitempty"`
+		// Symlinks determines how symlinks are handled when walking, either "skip", "follow" or "target-in-tree".
+		Symlinks string `toml:"symlinks,omitempty"`
+		// WalkCommand is the command used to list files when walking with a command, as a list of args.
+		WalkCommand []string `toml:"walk_command,omitempty"`
+		// IgnoreFiles are the names of ignore files, at any level of the tree, containing patterns in .gitignore syntax
+		// for paths which should be skipped when walking, in addition to .treefmtignore files.
+		IgnoreFiles []string `toml:"ignore_files,omitempty"`
+		// MaxFileSize is the size in bytes above which formatters are not applied to a file, unless they specify their
+		// own. 0 means there is no limit.
+		MaxFileSize int64 `toml:"max_file_size,omitempty"`
+		// SkipBinary indicates formatters should not be applied to binary files, or files which are not valid UTF-8.
+		SkipBinary bool `toml:"skip_binary,omitempty"`
+		// OutputCacheDir is an optional directory, relative to the tree root, in which formatted outputs are stored by
+		// the content of their input, so they can be reused without running the formatters again.
+		OutputCacheDir string `toml:"output_cache_dir,omitempty"`
+		// CacheDir is an optional directory, relative to the tree root, in which the cache is stored instead of the
+		// user's cache directory.
+		CacheDir string `toml:"cache_dir,omitempty"`
 	} `toml:"global"`
 	Formatters map[string]*Formatter `toml:"formatter"`
 }
@@ -21,6 +42,19 @@ func ReadFile(path string, names []string) (cfg *Config, err error) {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
+	// formatters inherit the global settings unless they specify their own
+	for _, formatterCfg := range cfg.Formatters {
+		if formatterCfg.GlobSyntax == "" {
+			formatterCfg.GlobSyntax = cfg.Global.GlobSyntax
+		}
+		if formatterCfg.MaxFileSize == nil {
+			formatterCfg.MaxFileSize = &cfg.Global.MaxFileSize
+		}
+		if formatterCfg.SkipBinary == nil {
+			formatterCfg.SkipBinary = &cfg.Global.SkipBinary
+		}
+	}
+
 	// filter formatters based on provided names
 	if len(names) > 0 {
 		filtered := make(map[string]*Formatter)
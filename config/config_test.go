@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -137,3 +139,56 @@ shfmt -i 2 -s -w "$@"
 	as.True(ok, "foo formatter not found")
 	as.Equal("foo-fmt", foo.Command)
 }
+
+func TestGlobSyntax(t *testing.T) {
+	as := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "treefmt.toml")
+	as.NoError(os.WriteFile(path, []byte(`
+[global]
+glob_syntax = "gitignore"
+
+[formatter.a]
+command = "a"
+
+[formatter.b]
+command = "b"
+glob_syntax = "default"
+`), 0o644))
+
+	cfg, err := ReadFile(path, nil)
+	as.NoError(err, "failed to read config file")
+
+	as.Equal("gitignore", cfg.Global.GlobSyntax)
+	// formatters inherit the global setting unless they specify their own
+	as.Equal("gitignore", cfg.Formatters["a"].GlobSyntax)
+	as.Equal("default", cfg.Formatters["b"].GlobSyntax)
+}
+
+func TestSkipSettings(t *testing.T) {
+	as := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "treefmt.toml")
+	as.NoError(os.WriteFile(path, []byte(`
+[global]
+max_file_size = 1024
+skip_binary = true
+
+[formatter.a]
+command = "a"
+
+[formatter.b]
+command = "b"
+max_file_size = 0
+skip_binary = false
+`), 0o644))
+
+	cfg, err := ReadFile(path, nil)
+	as.NoError(err, "failed to read config file")
+
+	// formatters inherit the global settings unless they specify their own, including to disable them
+	as.Equal(int64(1024), *cfg.Formatters["a"].MaxFileSize)
+	as.True(*cfg.Formatters["a"].SkipBinary)
+	as.Equal(int64(0), *cfg.Formatters["b"].MaxFileSize)
+	as.False(*cfg.Formatters["b"].SkipBinary)
+}
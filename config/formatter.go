@@ -3,12 +3,34 @@ package config
 type Formatter struct {
 	// Command is the command to invoke when applying this Formatter.
 	Command string `toml:"command"`
+	// Wasm is the path to a WebAssembly module to execute instead of Command, relative to the tree root.
+	Wasm string `toml:"wasm,omitempty"`
+	// Worker indicates Command supports the persistent worker protocol, and should be kept running between batches.
+	Worker bool `toml:"worker,omitempty"`
 	// Options are an optional list of args to be passed to Command.
 	Options []string `toml:"options,omitempty"`
 	// Includes is a list of glob patterns used to determine whether this Formatter should be applied against a path.
 	Includes []string `toml:"includes,omitempty"`
 	// Excludes is an optional list of glob patterns used to exclude certain files from this Formatter.
 	Excludes []string `toml:"excludes,omitempty"`
+	// GlobSyntax determines how Includes and Excludes are interpreted, either "default" or "gitignore".
+	// Defaults to the global setting.
+	GlobSyntax string `toml:"glob_syntax,omitempty"`
+	// ConfigFiles are the paths of files, relative to the tree root, which configure Command, such as .prettierrc.
+	// Their contents are part of the Formatter's fingerprint when caching outputs.
+	ConfigFiles []string `toml:"config_files,omitempty"`
+	// IgnoreFiles are the names of ignore files, at any level of the tree, containing patterns in .gitignore syntax for
+	// paths this Formatter should not be applied to.
+	IgnoreFiles []string `toml:"ignore_files,omitempty"`
+	// MaxFileSize is the size in bytes above which this Formatter is not applied to a file, with 0 meaning there is no
+	// limit. Defaults to the global setting when unset.
+	MaxFileSize *int64 `toml:"max_file_size,omitempty"`
+	// SkipBinary indicates this Formatter should not be applied to binary files, or files which are not valid UTF-8.
+	// Defaults to the global setting when unset.
+	SkipBinary *bool `toml:"skip_binary,omitempty"`
+	// CPUs is the number of cpus this Formatter uses when processing a batch, used when scheduling batches.
+	// Defaults to 1.
+	CPUs int `toml:"cpus,omitempty"`
 	// Indicates the order of precedence when executing this Formatter in a sequence of Formatters.
 	Priority int `toml:"priority,omitempty"`
 }
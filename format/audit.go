@@ -0,0 +1,220 @@
+package format
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/walk"
+)
+
+// treeEntry records the size and modification time of a file within a tree snapshot.
+type treeEntry struct {
+	size    int64
+	modTime time.Time
+}
+
+// TreeSnapshot is a point in time record of the metadata for every file beneath a tree root, keyed by relative path.
+type TreeSnapshot map[string]treeEntry
+
+// Auditor detects the paths a Formatter affects outside the batch of files it is given, by snapshotting the tree
+// before and after it is applied. Paths which are skipped when walking, and paths owned by treefmt such as the cache,
+// are not snapshotted.
+//
+// The snapshot taken after a Formatter is applied is reused as the snapshot before the next, so an Auditor assumes
+// nothing else is modifying the tree in between. It is the caller's responsibility to ensure batches are not being
+// processed concurrently, and to call Settle once it has finished modifying the files in a batch.
+type Auditor struct {
+	root    string
+	ignorer *walk.Ignorer
+	// relative paths of files and directories owned by treefmt
+	owned []string
+
+	snapshot TreeSnapshot
+}
+
+// NewAuditor returns an Auditor for the tree beneath root. Any paths skipped by ignorer are not audited, nor are any
+// of the owned paths, which are absolute and may be outside the tree.
+func NewAuditor(root string, ignorer *walk.Ignorer, owned ...string) *Auditor {
+	a := Auditor{root: root, ignorer: ignorer}
+	for _, path := range owned {
+		if path == "" {
+			continue
+		} else if relPath, err := filepath.Rel(root, path); err == nil && !isOutside(relPath) {
+			a.owned = append(a.owned, relPath)
+		}
+	}
+	return &a
+}
+
+// isOutside returns true if relPath is outside the directory it is relative to.
+func isOutside(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, "../")
+}
+
+// skip returns true if relPath should not be audited.
+func (a *Auditor) skip(relPath string, isDir bool) (bool, error) {
+	for _, owned := range a.owned {
+		if relPath == owned || strings.HasPrefix(relPath, owned+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+	if isDir && filepath.Base(relPath) == ".git" {
+		return true, nil
+	} else if a.ignorer == nil {
+		return false, nil
+	}
+	return a.ignorer.Ignored(relPath, isDir)
+}
+
+// take walks the tree and records the size and modification time of every file which is audited.
+func (a *Auditor) take() (TreeSnapshot, error) {
+	snapshot := make(TreeSnapshot)
+
+	err := filepath.WalkDir(a.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if path == a.root {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(a.root, path)
+		if err != nil {
+			return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
+		}
+
+		if skip, err := a.skip(relPath, d.IsDir()); err != nil {
+			return fmt.Errorf("failed to check if %s is ignored: %w", path, err)
+		} else if skip && d.IsDir() {
+			return filepath.SkipDir
+		} else if skip || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		snapshot[relPath] = treeEntry{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot tree %s: %w", a.root, err)
+	}
+
+	return snapshot, nil
+}
+
+// Settle updates the snapshot with the current state of the files in a batch, once the caller has finished
+// modifying them, so they are not reported when auditing the next batch.
+func (a *Auditor) Settle(batch []*Task) {
+	if a.snapshot == nil {
+		return
+	}
+	for _, task := range batch {
+		if info, err := os.Stat(task.File.Path); err != nil {
+			delete(a.snapshot, task.File.RelPath)
+		} else {
+			a.snapshot[task.File.RelPath] = treeEntry{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+}
+
+// AuditReport lists the paths outside a batch which were modified, created or deleted whilst a Formatter was applied.
+type AuditReport struct {
+	Formatter string
+	Modified  []string
+	Created   []string
+	Deleted   []string
+}
+
+// Empty returns true if no paths outside the batch were affected.
+func (r *AuditReport) Empty() bool {
+	return len(r.Modified) == 0 && len(r.Created) == 0 && len(r.Deleted) == 0
+}
+
+// Count returns the total number of paths outside the batch which were affected.
+func (r *AuditReport) Count() int {
+	return len(r.Modified) + len(r.Created) + len(r.Deleted)
+}
+
+func (r *AuditReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("formatter '%s' affected %d path(s) it was not given:", r.Formatter, r.Count()))
+
+	write := func(kind string, paths []string) {
+		for _, p := range paths {
+			sb.WriteString(fmt.Sprintf("\n  %s: %s", kind, p))
+		}
+	}
+
+	write("modified", r.Modified)
+	write("created", r.Created)
+	write("deleted", r.Deleted)
+
+	return sb.String()
+}
+
+// Apply applies a Formatter to tasks, returning a report of any paths which were modified, created or deleted outside
+// of batch, which contains all the tasks whose files are expected to change.
+func (a *Auditor) Apply(ctx context.Context, formatter *Formatter, tasks []*Task, batch []*Task) (*AuditReport, error) {
+	before := a.snapshot
+	if before == nil {
+		var err error
+		if before, err = a.take(); err != nil {
+			return nil, err
+		}
+	}
+
+	// if applying fails, the tree must be snapshotted again next time
+	a.snapshot = nil
+
+	if err := formatter.Apply(ctx, tasks); err != nil {
+		return nil, err
+	}
+
+	after, err := a.take()
+	if err != nil {
+		return nil, err
+	}
+	a.snapshot = after
+
+	// files in the batch are expected to change
+	expected := make(map[string]bool, len(batch))
+	for _, task := range batch {
+		expected[task.File.RelPath] = true
+	}
+
+	report := AuditReport{Formatter: formatter.Name()}
+
+	for path, entry := range after {
+		if expected[path] {
+			continue
+		}
+		prev, ok := before[path]
+		if !ok {
+			report.Created = append(report.Created, path)
+		} else if prev.size != entry.size || !prev.modTime.Equal(entry.modTime) {
+			report.Modified = append(report.Modified, path)
+		}
+	}
+
+	for path := range before {
+		if _, ok := after[path]; !ok && !expected[path] {
+			report.Deleted = append(report.Deleted, path)
+		}
+	}
+
+	// sort for deterministic output
+	slices.Sort(report.Modified)
+	slices.Sort(report.Created)
+	slices.Sort(report.Deleted)
+
+	return &report, nil
+}
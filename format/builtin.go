@@ -0,0 +1,103 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"os"
+	"strings"
+
+	"git.numtide.com/numtide/treefmt/walk"
+)
+
+// BuiltinPrefix is used in a Formatter's Command to select one of the builtin engines e.g. `builtin:gofmt`.
+const BuiltinPrefix = "builtin:"
+
+// builtinFunc formats the contents of a file, returning the formatted contents.
+type builtinFunc func(src []byte) ([]byte, error)
+
+// builtins are the engines which are linked into treefmt, keyed by name.
+// There is no builtin for TOML, as github.com/BurntSushi/toml discards comments when decoding and sorts keys when
+// encoding, so re-encoding a document would lose its comments and reorder it.
+var builtins = map[string]builtinFunc{
+	"gofmt": format.Source,
+	"json":  formatJson,
+}
+
+// IsBuiltin returns true if command refers to a builtin engine.
+func IsBuiltin(command string) bool {
+	return strings.HasPrefix(command, BuiltinPrefix)
+}
+
+// builtinEngine formats files in-process using a builtinFunc.
+type builtinEngine struct {
+	name       string
+	fn         builtinFunc
+	executable string
+}
+
+func newBuiltinEngine(command string) (*builtinEngine, error) {
+	name := strings.TrimPrefix(command, BuiltinPrefix)
+
+	fn, ok := builtins[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown builtin formatter '%s'", ErrCommandNotFound, name)
+	}
+
+	// builtins are part of the treefmt binary, so they change whenever it does
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the treefmt executable: %w", err)
+	}
+
+	return &builtinEngine{
+		name:       name,
+		fn:         fn,
+		executable: executable,
+	}, nil
+}
+
+func (b *builtinEngine) Executable() string {
+	return b.executable
+}
+
+func (b *builtinEngine) Format(ctx context.Context, files []*walk.File) error {
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		src, err := os.ReadFile(file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+
+		out, err := b.fn(src)
+		if err != nil {
+			return fmt.Errorf("builtin formatter '%s' failed to format %s: %w", b.name, file.RelPath, err)
+		}
+
+		// only write if there was a change, so we don't needlessly modify the mod time
+		if bytes.Equal(src, out) {
+			continue
+		}
+
+		if err = os.WriteFile(file.Path, out, 0); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// formatJson indents JSON documents with two spaces and a trailing newline, preserving the order of keys.
+func formatJson(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(src), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,41 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Diff produces a line oriented diff between before and after, containing only the lines which were removed or added.
+func Diff(path string, before []byte, after []byte) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("--- a/%s\n+++ b/%s\n", path, path))
+
+	for _, d := range diff.Do(string(before), string(after)) {
+		var prefix string
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			prefix = "-"
+		case diffmatchpatch.DiffInsert:
+			prefix = "+"
+		default:
+			continue
+		}
+
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			sb.WriteString(prefix)
+			sb.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return sb.String()
+}
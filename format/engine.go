@@ -0,0 +1,92 @@
+package format
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync/atomic"
+
+	"git.numtide.com/numtide/treefmt/walk"
+
+	"github.com/charmbracelet/log"
+)
+
+// Engine is responsible for formatting a batch of files on behalf of a Formatter.
+type Engine interface {
+	// Executable returns the path of the binary which performs the formatting.
+	// It is used when determining if a formatter has changed between invocations.
+	Executable() string
+	// Format formats the given files in place.
+	Format(ctx context.Context, files []*walk.File) error
+}
+
+// Hasher is implemented by engines which can provide a content hash of their executable.
+// When available, the hash is used in addition to the size and mod time of the executable to determine if a formatter
+// has changed between invocations.
+type Hasher interface {
+	Hash() string
+}
+
+// execEngine formats files by invoking an external command with the files appended to its args.
+type execEngine struct {
+	name       string
+	command    string
+	options    []string
+	executable string
+	workingDir string
+	log        *log.Logger
+
+	// counts the number of batches processed, used to name transcripts
+	batches atomic.Int32
+}
+
+// describe returns a description of an invocation for the start of a transcript.
+func (e *execEngine) describe(commandLine string) string {
+	return fmt.Sprintf("command: %s\nworking directory: %s", commandLine, e.workingDir)
+}
+
+func (e *execEngine) Executable() string {
+	return e.executable
+}
+
+func (e *execEngine) Format(ctx context.Context, files []*walk.File) error {
+	// construct args, starting with config
+	args := e.options
+
+	// append paths to the args
+	for _, file := range files {
+		args = append(args, file.RelPath)
+	}
+
+	// execute the command
+	cmd := exec.CommandContext(ctx, e.executable, args...)
+	// replace the default Cancel handler installed by CommandContext because it sends SIGKILL (-9).
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.Dir = e.workingDir
+
+	// log out the command being executed
+	e.log.Debugf("executing: %s", cmd.String())
+
+	// stream output line by line
+	output, err := newBatchLog(e.log, e.name, e.batches.Add(1), e.describe(cmd.String()))
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Run()
+	if closeErr := output.Close(err); closeErr != nil {
+		e.log.Errorf("failed to close transcript: %v", closeErr)
+	}
+
+	if err != nil {
+		output.reportFailure(e.name)
+		return fmt.Errorf("formatter '%s' with options '%v' failed to apply: %w", e.command, e.options, err)
+	}
+
+	return nil
+}
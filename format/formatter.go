@@ -2,10 +2,17 @@ package format
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"git.numtide.com/numtide/treefmt/walk"
@@ -13,7 +20,6 @@ import (
 	"git.numtide.com/numtide/treefmt/config"
 
 	"github.com/charmbracelet/log"
-	"github.com/gobwas/glob"
 )
 
 // ErrCommandNotFound is returned when the Command for a Formatter is not available.
@@ -21,21 +27,102 @@ var ErrCommandNotFound = errors.New("formatter command not found in PATH")
 
 // Formatter represents a command which should be applied to a filesystem.
 type Formatter struct {
-	name   string
-	config *config.Formatter
+	name     string
+	config   *config.Formatter
+	treeRoot string
 
-	log        *log.Logger
-	executable string // path to the executable described by Command
-	workingDir string
+	log    *log.Logger
+	engine Engine // performs the formatting, either in-process or by executing Command
 
 	// internal compiled versions of Includes and Excludes.
-	includes []glob.Glob
-	excludes []glob.Glob
+	includes Matcher
+	excludes Matcher
+	// optional, matches paths ignored by any of the formatter's IgnoreFiles.
+	ignored Matcher
+
+	// computed on demand, as it requires hashing the executable
+	fingerprintOnce sync.Once
+	fingerprint     string
+	fingerprintErr  error
 }
 
 // Executable returns the path to the executable defined by Command
 func (f *Formatter) Executable() string {
-	return f.executable
+	return f.engine.Executable()
+}
+
+// Hash returns a content hash of the executable, if the underlying engine provides one, or an empty string otherwise.
+func (f *Formatter) Hash() string {
+	if h, ok := f.engine.(Hasher); ok {
+		return h.Hash()
+	}
+	return ""
+}
+
+// Fingerprint returns a hash of what determines the output of the Formatter: its command or module, its options, the
+// content of the executable it runs and the contents of its ConfigFiles. Unlike the size and mod time of the
+// executable, it is the same on any machine with the same formatter installed, and changes when a formatter is
+// upgraded in place.
+// The executable and config files are hashed the first time Fingerprint is called, and an error is returned if the
+// executable cannot be read. Config files which do not exist are recorded as missing.
+func (f *Formatter) Fingerprint() (string, error) {
+	f.fingerprintOnce.Do(func() {
+		hash := f.Hash()
+		if hash == "" {
+			if hash, f.fingerprintErr = HashFile(f.Executable()); f.fingerprintErr != nil {
+				f.log.Warnf("outputs will not be cached: %v", f.fingerprintErr)
+				return
+			}
+		}
+
+		h := sha256.New()
+		_, _ = fmt.Fprintf(h, "command=%q\nwasm=%q\noptions=%q\nhash=%q\n",
+			f.config.Command, f.config.Wasm, f.config.Options, hash)
+
+		for _, configFile := range f.config.ConfigFiles {
+			path := configFile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(f.treeRoot, path)
+			}
+
+			configHash, err := HashFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				configHash = "missing"
+			} else if err != nil {
+				f.fingerprintErr = err
+				f.log.Warnf("outputs will not be cached: %v", err)
+				return
+			}
+			_, _ = fmt.Fprintf(h, "config=%q %q\n", configFile, configHash)
+		}
+
+		f.fingerprint = hex.EncodeToString(h.Sum(nil))
+	})
+	return f.fingerprint, f.fingerprintErr
+}
+
+// HashFile returns the sha256 of the contents of the file at path.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ConfigHash returns a hash of the Formatter's configuration, including its command, options, includes, excludes and
+// priority. It is used to determine if the configuration has changed between invocations.
+func (f *Formatter) ConfigHash() string {
+	// the config only consists of strings, numbers and bools, so encoding it cannot fail
+	bytes, _ := json.Marshal(f.config)
+	digest := sha256.Sum256(bytes)
+	return hex.EncodeToString(digest[:])
 }
 
 func (f *Formatter) Name() string {
@@ -46,57 +133,65 @@ func (f *Formatter) Priority() int {
 	return f.config.Priority
 }
 
+// GlobSyntax returns how the Formatter's includes and excludes are interpreted.
+func (f *Formatter) GlobSyntax() GlobSyntax {
+	if f.config.GlobSyntax == "" {
+		return GlobSyntaxDefault
+	}
+	return GlobSyntax(f.config.GlobSyntax)
+}
+
+// CPUs returns the number of cpus the Formatter uses when processing a batch, defaulting to 1.
+func (f *Formatter) CPUs() int {
+	return max(1, f.config.CPUs)
+}
+
 func (f *Formatter) Apply(ctx context.Context, tasks []*Task) error {
 	start := time.Now()
 
-	// construct args, starting with config
-	args := f.config.Options
-
 	// exit early if nothing to process
 	if len(tasks) == 0 {
 		return nil
 	}
 
-	// append paths to the args
-	for _, task := range tasks {
-		args = append(args, task.File.RelPath)
-	}
-
-	// execute the command
-	cmd := exec.CommandContext(ctx, f.executable, args...)
-	// replace the default Cancel handler installed by CommandContext because it sends SIGKILL (-9).
-	cmd.Cancel = func() error {
-		return cmd.Process.Signal(os.Interrupt)
+	files := make([]*walk.File, len(tasks))
+	for i, task := range tasks {
+		files[i] = task.File
 	}
-	cmd.Dir = f.workingDir
-
-	// log out the command being executed
-	f.log.Debugf("executing: %s", cmd.String())
 
-	if out, err := cmd.CombinedOutput(); err != nil {
-		if len(out) > 0 {
-			_, _ = fmt.Fprintf(os.Stderr, "%s error:\n%s\n", f.name, out)
-		}
-		return fmt.Errorf("formatter '%s' with options '%v' failed to apply: %w", f.config.Command, f.config.Options, err)
+	if err := f.engine.Format(ctx, files); err != nil {
+		return err
 	}
 
-	//
-
 	f.log.Infof("%v file(s) processed in %v", len(tasks), time.Since(start))
 
 	return nil
 }
 
+// Close releases any resources held by the Formatter, such as persistent worker processes.
+func (f *Formatter) Close() error {
+	if c, ok := f.engine.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // Wants is used to test if a Formatter wants a path based on it's configured Includes and Excludes patterns.
 // Returns true if the Formatter should be applied to path, false otherwise.
 func (f *Formatter) Wants(file *walk.File) bool {
-	match := !PathMatches(file.RelPath, f.excludes) && PathMatches(file.RelPath, f.includes)
+	match := f.Matches(file.RelPath)
 	if match {
 		f.log.Debugf("match: %v", file)
 	}
 	return match
 }
 
+// Matches is the same as Wants, but without logging, for use outside of formatting.
+func (f *Formatter) Matches(relPath string) bool {
+	return !f.excludes.Matches(relPath) && f.includes.Matches(relPath) &&
+		!(f.ignored != nil && f.ignored.Matches(relPath))
+}
+
 // NewFormatter is used to create a new Formatter.
 func NewFormatter(
 	name string,
@@ -110,33 +205,74 @@ func NewFormatter(
 	// capture config and the formatter's name
 	f.name = name
 	f.config = cfg
-	f.workingDir = treeRoot
-
-	// test if the formatter is available
-	executable, err := exec.LookPath(cfg.Command)
-	if errors.Is(err, exec.ErrNotFound) {
-		return nil, ErrCommandNotFound
-	} else if err != nil {
-		return nil, err
-	}
-	f.executable = executable
+	f.treeRoot = treeRoot
 
 	// initialise internal state
 	if cfg.Priority > 0 {
-		f.log = log.WithPrefix(fmt.Sprintf("format | %s[%d]", name, cfg.Priority))
+		f.log = log.WithPrefix(fmt.Sprintf("formatter | %s[%d]", name, cfg.Priority))
 	} else {
-		f.log = log.WithPrefix(fmt.Sprintf("format | %s", name))
+		f.log = log.WithPrefix(fmt.Sprintf("formatter | %s", name))
 	}
 
-	f.includes, err = CompileGlobs(cfg.Includes)
+	// determine which engine to use
+	if cfg.Wasm != "" {
+		if cfg.Command != "" {
+			return nil, fmt.Errorf("formatter '%v' cannot specify both a command and a wasm module", f.name)
+		}
+		path := cfg.Wasm
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(treeRoot, path)
+		}
+		if f.engine, err = newWasmEngine(name, path, cfg.Options, f.log); err != nil {
+			return nil, err
+		}
+	} else if IsBuiltin(cfg.Command) {
+		if len(cfg.Options) > 0 {
+			return nil, fmt.Errorf("builtin formatter '%v' does not accept options", f.name)
+		}
+		if f.engine, err = newBuiltinEngine(cfg.Command); err != nil {
+			return nil, err
+		}
+	} else {
+		// test if the formatter is available
+		executable, err := exec.LookPath(cfg.Command)
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, ErrCommandNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		engine := &execEngine{
+			name:       name,
+			command:    cfg.Command,
+			options:    cfg.Options,
+			executable: executable,
+			workingDir: treeRoot,
+			log:        f.log,
+		}
+
+		if cfg.Worker {
+			f.engine = newWorkerEngine(engine)
+		} else {
+			f.engine = engine
+		}
+	}
+
+	syntax := GlobSyntax(cfg.GlobSyntax)
+
+	f.includes, err = CompileMatcher(syntax, cfg.Includes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile formatter '%v' includes: %w", f.name, err)
 	}
 
-	f.excludes, err = CompileGlobs(cfg.Excludes)
+	f.excludes, err = CompileMatcher(syntax, cfg.Excludes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile formatter '%v' excludes: %w", f.name, err)
 	}
 
+	if len(cfg.IgnoreFiles) > 0 {
+		f.ignored = walk.NewIgnoreFiles(treeRoot, cfg.IgnoreFiles)
+	}
+
 	return &f, nil
 }
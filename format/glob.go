@@ -2,10 +2,71 @@ package format
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/gobwas/glob"
 )
 
+// GlobSyntax determines how include and exclude patterns are interpreted.
+type GlobSyntax string
+
+const (
+	// GlobSyntaxDefault is the original treefmt syntax, where patterns are right-matching and `*` crosses directories.
+	GlobSyntaxDefault GlobSyntax = "default"
+	// GlobSyntaxGitignore interprets patterns in the same way as a .gitignore file.
+	GlobSyntaxGitignore GlobSyntax = "gitignore"
+)
+
+// Matcher is used to test if a path matches a list of patterns.
+type Matcher interface {
+	Matches(path string) bool
+}
+
+// CompileMatcher prepares a Matcher for the given patterns, interpreting them according to syntax.
+// An empty syntax is treated as GlobSyntaxDefault.
+func CompileMatcher(syntax GlobSyntax, patterns []string) (Matcher, error) {
+	switch syntax {
+	case "", GlobSyntaxDefault:
+		globs, err := CompileGlobs(patterns)
+		if err != nil {
+			return nil, err
+		}
+		return globMatcher(globs), nil
+	case GlobSyntaxGitignore:
+		return compileGitignore(patterns), nil
+	default:
+		return nil, fmt.Errorf("unknown glob syntax '%v'", syntax)
+	}
+}
+
+// globMatcher matches paths using the default syntax.
+type globMatcher []glob.Glob
+
+func (g globMatcher) Matches(path string) bool {
+	return PathMatches(path, g)
+}
+
+// gitignoreMatcher matches paths using .gitignore syntax.
+// Patterns are evaluated in order, with the last matching pattern taking precedence. A pattern prefixed with `!`
+// negates any previous match.
+type gitignoreMatcher struct {
+	matcher gitignore.Matcher
+}
+
+func compileGitignore(patterns []string) gitignoreMatcher {
+	ps := make([]gitignore.Pattern, len(patterns))
+	for i, pattern := range patterns {
+		ps[i] = gitignore.ParsePattern(pattern, nil)
+	}
+	return gitignoreMatcher{matcher: gitignore.NewMatcher(ps)}
+}
+
+func (g gitignoreMatcher) Matches(path string) bool {
+	// we only ever match against files
+	return g.matcher.Match(strings.Split(path, "/"), false)
+}
+
 // CompileGlobs prepares the globs, where the patterns are all right-matching.
 func CompileGlobs(patterns []string) ([]glob.Glob, error) {
 	globs := make([]glob.Glob, len(patterns))
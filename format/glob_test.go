@@ -39,3 +39,57 @@ func TestGlobs(t *testing.T) {
 	r.False(format.PathMatches("test/LICENSE", globs))
 	r.False(format.PathMatches("LICENSE.txt", globs))
 }
+
+func TestGitignoreGlobs(t *testing.T) {
+	r := require.New(t)
+
+	var (
+		matcher format.Matcher
+		err     error
+	)
+
+	// File extension, `*` does not cross directories but unanchored patterns match at any depth
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"*.txt"})
+	r.NoError(err)
+	r.True(matcher.Matches("bar.txt"))
+	r.True(matcher.Matches("test/foo/bar.txt"))
+	r.False(matcher.Matches("test/foo/bar.txtz"))
+
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"test/*.txt"})
+	r.NoError(err)
+	r.True(matcher.Matches("test/bar.txt"))
+	r.False(matcher.Matches("test/foo/bar.txt"))
+
+	// Double asterisk
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"test/**/*.txt"})
+	r.NoError(err)
+	r.True(matcher.Matches("test/bar.txt"))
+	r.True(matcher.Matches("test/foo/bar.txt"))
+	r.False(matcher.Matches("other/foo/bar.txt"))
+
+	// Anchoring
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"/LICENSE"})
+	r.NoError(err)
+	r.True(matcher.Matches("LICENSE"))
+	r.False(matcher.Matches("test/LICENSE"))
+
+	// Directories
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"haskell/"})
+	r.NoError(err)
+	r.True(matcher.Matches("haskell/Foo.hs"))
+	r.True(matcher.Matches("examples/haskell/Nested/Foo.hs"))
+	r.False(matcher.Matches("haskell-frontend/Main.hs"))
+	r.False(matcher.Matches("haskell"))
+
+	// Re-inclusion, where the last matching pattern wins
+	matcher, err = format.CompileMatcher(format.GlobSyntaxGitignore, []string{"*.md", "!README.md", "docs/README.md"})
+	r.NoError(err)
+	r.True(matcher.Matches("CHANGELOG.md"))
+	r.False(matcher.Matches("README.md"))
+	r.False(matcher.Matches("test/README.md"))
+	r.True(matcher.Matches("docs/README.md"))
+
+	// Unknown syntax
+	_, err = format.CompileMatcher("foo", []string{"*.txt"})
+	r.ErrorContains(err, "unknown glob syntax")
+}
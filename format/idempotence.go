@@ -0,0 +1,108 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/walk"
+)
+
+// Violation describes a file which was changed by a Formatter when it was re-applied to already formatted content.
+type Violation struct {
+	Formatter string
+	File      *walk.File
+	Diff      string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("formatter '%s' is not idempotent for %s:\n%s", v.Formatter, v.File.RelPath, v.Diff)
+}
+
+// snapshot captures the contents and modification time of a file.
+type snapshot struct {
+	contents []byte
+	modTime  time.Time
+}
+
+func takeSnapshot(file *walk.File) (*snapshot, error) {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", file.Path, err)
+	}
+
+	contents, err := os.ReadFile(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file.Path, err)
+	}
+
+	return &snapshot{contents: contents, modTime: info.ModTime()}, nil
+}
+
+// ApplyFunc applies a Formatter to a batch of tasks.
+type ApplyFunc func(ctx context.Context, formatter *Formatter, tasks []*Task) error
+
+// VerifyIdempotence re-applies a sequence of formatters to a batch of tasks which have already been formatted, using
+// apply. After each formatter is applied, the contents of every file are compared with their previous contents, and a
+// Violation is returned for any file which changed again.
+//
+// Files which were not changed by the second pass have their modification time restored, so that verification does
+// not register as a change further down the pipeline.
+func VerifyIdempotence(ctx context.Context, formatters []*Formatter, tasks []*Task, apply ApplyFunc) ([]Violation, error) {
+	// capture the state of each file after the first pass
+	snapshots := make([]*snapshot, len(tasks))
+	for i, task := range tasks {
+		s, err := takeSnapshot(task.File)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[i] = s
+	}
+
+	var violations []Violation
+
+	for _, formatter := range formatters {
+		if err := apply(ctx, formatter, tasks); err != nil {
+			return nil, err
+		}
+
+		for i, task := range tasks {
+			contents, err := os.ReadFile(task.File.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", task.File.Path, err)
+			}
+
+			if bytes.Equal(snapshots[i].contents, contents) {
+				continue
+			}
+
+			violations = append(violations, Violation{
+				Formatter: formatter.Name(),
+				File:      task.File,
+				Diff:      Diff(task.File.RelPath, snapshots[i].contents, contents),
+			})
+
+			// compare subsequent formatters against the latest contents
+			snapshots[i].contents = contents
+		}
+	}
+
+	// restore the mod time of any files which were left untouched by the second pass
+	changed := make(map[*walk.File]bool, len(violations))
+	for _, v := range violations {
+		changed[v.File] = true
+	}
+
+	for i, task := range tasks {
+		if changed[task.File] {
+			continue
+		}
+		if err := os.Chtimes(task.File.Path, time.Time{}, snapshots[i].modTime); err != nil {
+			return nil, fmt.Errorf("failed to restore mod time for %s: %w", task.File.Path, err)
+		}
+	}
+
+	return violations, nil
+}
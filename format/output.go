@@ -0,0 +1,143 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var (
+	// OutputLevel is the level at which each line of output from a formatter is logged.
+	OutputLevel = log.WarnLevel
+	// LogDir is an optional directory into which a transcript of each batch processed by a formatter is written.
+	LogDir string
+)
+
+// batchLog captures the output of a formatter whilst it processes a batch. Each line is streamed to a logger at
+// OutputLevel and, if LogDir has been set, recorded in a transcript along with the command line and exit status.
+type batchLog struct {
+	lock    sync.Mutex
+	log     *log.Logger
+	start   time.Time
+	output  bytes.Buffer
+	partial []byte
+	file    *os.File
+}
+
+// newBatchLog creates a batchLog for a batch identified by name and sequence number. The description is written at
+// the start of the transcript e.g. the command line being executed.
+func newBatchLog(logger *log.Logger, name string, seq int32, description string) (*batchLog, error) {
+	b := &batchLog{
+		log:   logger,
+		start: time.Now(),
+	}
+
+	if LogDir == "" {
+		return b, nil
+	}
+
+	if err := os.MkdirAll(LogDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory %s: %w", LogDir, err)
+	}
+
+	path := filepath.Join(LogDir, fmt.Sprintf("%s-%d.log", name, seq))
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transcript %s: %w", path, err)
+	}
+	b.file = file
+
+	_, _ = fmt.Fprintf(file, "%s\nstarted: %s\n\n", description, b.start.Format(time.RFC3339))
+
+	return b, nil
+}
+
+// Write implements io.Writer, logging each complete line as it is received.
+func (b *batchLog) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.output.Write(p)
+
+	if b.file != nil {
+		if _, err := b.file.Write(p); err != nil {
+			return 0, fmt.Errorf("failed to write transcript: %w", err)
+		}
+	}
+
+	b.partial = append(b.partial, p...)
+	for {
+		idx := bytes.IndexByte(b.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		b.logLine(b.partial[:idx])
+		b.partial = b.partial[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+func (b *batchLog) logLine(line []byte) {
+	b.log.Log(OutputLevel, strings.TrimRight(string(line), "\r"))
+}
+
+// Output returns everything which has been written so far.
+func (b *batchLog) Output() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.output.Bytes()
+}
+
+// Close flushes any remaining output and records the exit status, as determined by err, in the transcript.
+func (b *batchLog) Close(err error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.partial) > 0 {
+		b.logLine(b.partial)
+		b.partial = nil
+	}
+
+	if b.file == nil {
+		return nil
+	}
+
+	status := "exit status: 0"
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = fmt.Sprintf("exit status: %d", exitErr.ExitCode())
+	} else if err != nil {
+		status = fmt.Sprintf("error: %v", err)
+	}
+
+	// ensure the status starts on a new line
+	if b.output.Len() > 0 && !bytes.HasSuffix(b.output.Bytes(), []byte("\n")) {
+		_, _ = b.file.WriteString("\n")
+	}
+
+	_, _ = fmt.Fprintf(b.file, "\n%s\nduration: %v\n", status, time.Since(b.start))
+
+	return b.file.Close()
+}
+
+// reportFailure prints the output of a failed batch to stderr, unless it has already been logged.
+func (b *batchLog) reportFailure(name string) {
+	if OutputLevel >= b.log.GetLevel() {
+		// the output was streamed to the logger
+		return
+	}
+	if out := b.Output(); len(out) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%s error:\n%s\n", name, out)
+	}
+}
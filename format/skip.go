@@ -0,0 +1,73 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"git.numtide.com/numtide/treefmt/walk"
+)
+
+// SniffSize is the number of bytes read from the start of a file when determining if it is binary.
+const SniffSize = 8000
+
+// IsBinary returns true if the first SniffSize bytes of the file at path contain a NUL byte or are not valid UTF-8.
+func IsBinary(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	buf := make([]byte, SniffSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	buf = buf[:n]
+
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return true, nil
+	}
+
+	// ignore a multibyte rune which has been cut off at the end of the block
+	if n == SniffSize {
+		for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(buf[i]) {
+				if !utf8.FullRune(buf[i:]) {
+					buf = buf[:i]
+				}
+				break
+			}
+		}
+	}
+
+	return !utf8.Valid(buf), nil
+}
+
+// Skips returns the reason this Formatter should not be applied to file because of its size or content, or an empty
+// string if it should be. isBinary is only called if the Formatter skips binary files.
+func (f *Formatter) Skips(file *walk.File, isBinary func() (bool, error)) (string, error) {
+	if f.TooLarge(file) {
+		return fmt.Sprintf("larger than max_file_size of %d bytes", *f.config.MaxFileSize), nil
+	}
+
+	if skip := f.config.SkipBinary; skip != nil && *skip {
+		binary, err := isBinary()
+		if err != nil {
+			return "", err
+		} else if binary {
+			return "binary or not valid UTF-8", nil
+		}
+	}
+
+	return "", nil
+}
+
+// TooLarge returns true if file is larger than the max_file_size of this Formatter.
+func (f *Formatter) TooLarge(file *walk.File) bool {
+	limit := f.config.MaxFileSize
+	return limit != nil && *limit > 0 && file.Info.Size() > *limit
+}
@@ -0,0 +1,40 @@
+package format
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBinary(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := t.TempDir()
+
+	for name, tc := range map[string]struct {
+		contents string
+		binary   bool
+	}{
+		"empty":      {"", false},
+		"text":       {"hello world\n", false},
+		"utf8":       {"héllo wörld ✓\n", false},
+		"nul":        {"hello\x00world", true},
+		"latin1":     {"h\xe9llo", true},
+		"late nul":   {strings.Repeat("a", SniffSize) + "\x00", false},
+		"cut rune":   {strings.Repeat("a", SniffSize-1) + "✓", false},
+		"bad at end": {strings.Repeat("a", SniffSize-1) + "\xff", true},
+	} {
+		path := filepath.Join(tempDir, name)
+		as.NoError(os.WriteFile(path, []byte(tc.contents), 0o644))
+
+		binary, err := IsBinary(path)
+		as.NoError(err)
+		as.Equal(tc.binary, binary, name)
+	}
+
+	_, err := IsBinary(filepath.Join(tempDir, "missing"))
+	as.ErrorContains(err, "failed to open")
+}
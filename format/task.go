@@ -40,3 +40,12 @@ func NewTask(file *walk.File, formatters []*Formatter) Task {
 		BatchKey:   key,
 	}
 }
+
+// CPUs returns the number of cpus required to process the task, which is the most required by any of its formatters.
+func (t *Task) CPUs() int64 {
+	var cpus int64 = 1
+	for _, f := range t.Formatters {
+		cpus = max(cpus, int64(f.CPUs()))
+	}
+	return cpus
+}
@@ -0,0 +1,185 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.numtide.com/numtide/treefmt/walk"
+
+	"github.com/charmbracelet/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmEngine formats files by executing a WebAssembly module with an embedded WASI runtime.
+//
+// For each batch, the files are copied into a temporary directory which is preopened as the module's root filesystem.
+// The module is invoked with Options followed by the relative paths of the files, in the same way as a command.
+// Once it has finished, any files which were changed are copied back into the tree.
+type wasmEngine struct {
+	name    string
+	path    string
+	options []string
+	hash    string
+	log     *log.Logger
+
+	// counts the number of batches processed, used to name transcripts
+	batches atomic.Int32
+
+	// the runtime and module are compiled lazily, on the first batch
+	once     sync.Once
+	initErr  error
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+func newWasmEngine(name string, path string, options []string, logger *log.Logger) (*wasmEngine, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: wasm module %s does not exist", ErrCommandNotFound, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read wasm module %s: %w", path, err)
+	}
+
+	digest := sha256.Sum256(contents)
+
+	return &wasmEngine{
+		name:    name,
+		path:    path,
+		options: options,
+		hash:    hex.EncodeToString(digest[:]),
+		log:     logger,
+	}, nil
+}
+
+func (w *wasmEngine) Executable() string {
+	return w.path
+}
+
+// Hash returns the sha256 of the WebAssembly module.
+func (w *wasmEngine) Hash() string {
+	return w.hash
+}
+
+func (w *wasmEngine) init(ctx context.Context) error {
+	w.once.Do(func() {
+		contents, err := os.ReadFile(w.path)
+		if err != nil {
+			w.initErr = fmt.Errorf("failed to read wasm module %s: %w", w.path, err)
+			return
+		}
+
+		w.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+		wasi_snapshot_preview1.MustInstantiate(ctx, w.runtime)
+
+		if w.compiled, err = w.runtime.CompileModule(ctx, contents); err != nil {
+			w.initErr = fmt.Errorf("failed to compile wasm module %s: %w", w.path, err)
+		}
+	})
+	return w.initErr
+}
+
+// Close closes the runtime, if it was created, releasing the compiled module.
+func (w *wasmEngine) Close() error {
+	if w.runtime == nil {
+		return nil
+	}
+	if err := w.runtime.Close(context.Background()); err != nil {
+		return fmt.Errorf("failed to close wasm runtime for %s: %w", w.path, err)
+	}
+	return nil
+}
+
+func (w *wasmEngine) Format(ctx context.Context, files []*walk.File) error {
+	if err := w.init(ctx); err != nil {
+		return err
+	}
+
+	// the module only has access to a copy of the files in the batch
+	dir, err := os.MkdirTemp("", "treefmt-wasm-*")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary directory for wasm module: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	originals := make([][]byte, len(files))
+
+	args := append([]string{w.name}, w.options...)
+
+	for i, file := range files {
+		contents, err := os.ReadFile(file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+		originals[i] = contents
+
+		tempPath := filepath.Join(dir, file.RelPath)
+		if err = os.MkdirAll(filepath.Dir(tempPath), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", tempPath, err)
+		}
+		if err = os.WriteFile(tempPath, contents, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", tempPath, err)
+		}
+
+		args = append(args, file.RelPath)
+	}
+
+	output, err := newBatchLog(
+		w.log, w.name, w.batches.Add(1),
+		fmt.Sprintf("wasm module: %s\nargs: %s", w.path, strings.Join(args[1:], " ")),
+	)
+	if err != nil {
+		return err
+	}
+
+	cfg := wazero.NewModuleConfig().
+		// allow multiple instances of the module to run concurrently
+		WithName("").
+		WithArgs(args...).
+		WithFSConfig(wazero.NewFSConfig().WithDirMount(dir, "/")).
+		WithStdout(output).
+		WithStderr(output).
+		WithSysWalltime().
+		WithSysNanotime()
+
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, cfg)
+	if mod != nil {
+		_ = mod.Close(ctx)
+	}
+	if closeErr := output.Close(err); closeErr != nil {
+		w.log.Errorf("failed to close transcript: %v", closeErr)
+	}
+
+	if err != nil {
+		output.reportFailure(w.name)
+		return fmt.Errorf("wasm formatter '%s' with options '%v' failed to apply: %w", w.path, w.options, err)
+	}
+
+	// copy back any files which were changed
+	for i, file := range files {
+		contents, err := os.ReadFile(filepath.Join(dir, file.RelPath))
+		if err != nil {
+			return fmt.Errorf("failed to read formatted output for %s: %w", file.RelPath, err)
+		}
+
+		if bytes.Equal(originals[i], contents) {
+			continue
+		}
+
+		if err = os.WriteFile(file.Path, contents, 0); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
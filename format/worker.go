@@ -0,0 +1,387 @@
+package format
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.numtide.com/numtide/treefmt/walk"
+)
+
+const (
+	// WorkerFlag is appended to a formatter's options when starting it as a persistent worker.
+	WorkerFlag = "--persistent-worker"
+	// WorkerProtocolVersion is the version of the persistent worker protocol which treefmt speaks.
+	WorkerProtocolVersion = 1
+)
+
+var (
+	// WorkerHandshakeTimeout is how long to wait for a persistent worker to respond to the initial handshake.
+	WorkerHandshakeTimeout = 30 * time.Second
+	// WorkerShutdownTimeout is how long to wait for a persistent worker to exit once its stdin has been closed, before
+	// it is killed.
+	WorkerShutdownTimeout = 5 * time.Second
+)
+
+// errWorkerHandshake is returned when a persistent worker fails to complete the handshake.
+var errWorkerHandshake = errors.New("persistent worker handshake failed")
+
+// WorkerRequest is written as a single line of JSON to a persistent worker's stdin.
+// A handshake is a request with Version set and no Paths.
+type WorkerRequest struct {
+	ID      int      `json:"id"`
+	Version int      `json:"version,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+}
+
+// WorkerResponse is read as a single line of JSON from a persistent worker's stdout.
+type WorkerResponse struct {
+	ID       int    `json:"id"`
+	Version  int    `json:"version,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output,omitempty"`
+}
+
+// worker is a single persistent worker process.
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	stderr *workerOutput
+	nextID int
+}
+
+// workerOutput routes the stderr of a persistent worker to the batchLog of the batch it is processing, so it is logged
+// and recorded in transcripts in the same way as the output of an executed formatter. Between batches, such as during
+// the handshake, it is logged through the formatter's logger.
+type workerOutput struct {
+	lock  sync.Mutex
+	batch *batchLog
+	idle  *batchLog
+}
+
+func (o *workerOutput) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.batch != nil {
+		return o.batch.Write(p)
+	}
+	return o.idle.Write(p)
+}
+
+// attach routes any further output to batch, or to the formatter's logger if batch is nil.
+func (o *workerOutput) attach(batch *batchLog) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.batch = batch
+}
+
+// flush logs any incomplete line of output once the worker has exited.
+func (o *workerOutput) flush() {
+	_ = o.idle.Close(nil)
+}
+
+func startWorker(e *execEngine) (*worker, error) {
+	args := append(append([]string{}, e.options...), WorkerFlag)
+
+	stderr := &workerOutput{idle: &batchLog{log: e.log}}
+
+	cmd := exec.Command(e.executable, args...)
+	cmd.Dir = e.workingDir
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin for persistent worker: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout for persistent worker: %w", err)
+	}
+
+	e.log.Debugf("starting persistent worker: %s", cmd.String())
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start persistent worker: %w", err)
+	}
+
+	w := &worker{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewScanner(stdout),
+		stderr: stderr,
+	}
+	// allow for large amounts of output in a response
+	w.stdout.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	// perform the handshake
+	ctx, cancel := context.WithTimeout(context.Background(), WorkerHandshakeTimeout)
+	defer cancel()
+
+	resp, err := w.do(ctx, WorkerRequest{Version: WorkerProtocolVersion})
+	if err != nil {
+		w.kill()
+		return nil, fmt.Errorf("%w: %w", errWorkerHandshake, err)
+	} else if resp.Version != WorkerProtocolVersion {
+		w.kill()
+		return nil, fmt.Errorf("%w: unsupported protocol version %d", errWorkerHandshake, resp.Version)
+	}
+
+	return w, nil
+}
+
+// do sends a request to the worker and waits for the response.
+func (w *worker) do(ctx context.Context, req WorkerRequest) (*WorkerResponse, error) {
+	w.nextID += 1
+	req.ID = w.nextID
+
+	bytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal worker request: %w", err)
+	}
+
+	if _, err = w.stdin.Write(append(bytes, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write worker request: %w", err)
+	}
+
+	type result struct {
+		resp *WorkerResponse
+		err  error
+	}
+
+	resultCh := make(chan result, 1)
+
+	go func() {
+		if !w.stdout.Scan() {
+			err := w.stdout.Err()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			resultCh <- result{err: fmt.Errorf("failed to read worker response: %w", err)}
+			return
+		}
+
+		var resp WorkerResponse
+		if err := json.Unmarshal(w.stdout.Bytes(), &resp); err != nil {
+			resultCh <- result{err: fmt.Errorf("failed to unmarshal worker response: %w", err)}
+			return
+		} else if resp.ID != req.ID {
+			resultCh <- result{err: fmt.Errorf("expected worker response with id %d, got %d", req.ID, resp.ID)}
+			return
+		}
+
+		resultCh <- result{resp: &resp}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// the worker is left in an unknown state, so it cannot be reused
+		w.kill()
+		return nil, ctx.Err()
+	case r := <-resultCh:
+		return r.resp, r.err
+	}
+}
+
+// close asks the worker to exit by closing its stdin, and waits for it to do so, killing it if it does not exit within
+// WorkerShutdownTimeout.
+func (w *worker) close() error {
+	_ = w.stdin.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.cmd.Wait()
+	}()
+
+	defer w.stderr.flush()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(WorkerShutdownTimeout):
+		_ = w.cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("killed after not exiting within %v", WorkerShutdownTimeout)
+	}
+}
+
+func (w *worker) kill() {
+	_ = w.cmd.Process.Kill()
+	_ = w.cmd.Wait()
+	w.stderr.flush()
+}
+
+// workerEngine formats files by sending batches to a pool of persistent worker processes, which are kept alive for
+// the duration of the run. If a worker fails the initial handshake, it falls back to an execEngine.
+type workerEngine struct {
+	*execEngine
+
+	size     int
+	fallback atomic.Bool
+
+	lock    sync.Mutex
+	started int
+	idle    chan *worker
+	all     []*worker
+}
+
+func newWorkerEngine(e *execEngine) *workerEngine {
+	size := runtime.NumCPU()
+	return &workerEngine{
+		execEngine: e,
+		size:       size,
+		idle:       make(chan *worker, size),
+	}
+}
+
+// acquire returns an idle worker, starting a new one if the pool is not yet full.
+func (e *workerEngine) acquire(ctx context.Context) (*worker, error) {
+	select {
+	case w := <-e.idle:
+		return w, nil
+	default:
+	}
+
+	e.lock.Lock()
+	if e.started < e.size {
+		e.started += 1
+		e.lock.Unlock()
+
+		w, err := startWorker(e.execEngine)
+		if err != nil {
+			e.lock.Lock()
+			e.started -= 1
+			e.lock.Unlock()
+			return nil, err
+		}
+
+		e.lock.Lock()
+		e.all = append(e.all, w)
+		e.lock.Unlock()
+
+		return w, nil
+	}
+	e.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case w := <-e.idle:
+		return w, nil
+	}
+}
+
+// discard removes a worker from the pool, allowing a replacement to be started.
+func (e *workerEngine) discard(w *worker) {
+	w.kill()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.started -= 1
+	for i := range e.all {
+		if e.all[i] == w {
+			e.all = append(e.all[:i], e.all[i+1:]...)
+			break
+		}
+	}
+}
+
+func (e *workerEngine) Format(ctx context.Context, files []*walk.File) error {
+	if e.fallback.Load() {
+		return e.execEngine.Format(ctx, files)
+	}
+
+	w, err := e.acquire(ctx)
+	if errors.Is(err, errWorkerHandshake) {
+		if !e.fallback.Swap(true) {
+			e.log.Warnf("falling back to executing %s for each batch: %v", e.command, err)
+		}
+		return e.execEngine.Format(ctx, files)
+	} else if err != nil {
+		return err
+	}
+
+	req := WorkerRequest{Paths: make([]string, len(files))}
+	for i, file := range files {
+		req.Paths[i] = file.RelPath
+	}
+
+	e.log.Debugf("sending %d path(s) to persistent worker %d", len(files), w.cmd.Process.Pid)
+
+	description := fmt.Sprintf(
+		"persistent worker: %d\npaths: %s\nworking directory: %s",
+		w.cmd.Process.Pid, strings.Join(req.Paths, " "), e.workingDir,
+	)
+
+	output, err := newBatchLog(e.log, e.name, e.batches.Add(1), description)
+	if err != nil {
+		e.idle <- w
+		return err
+	}
+
+	w.stderr.attach(output)
+	resp, err := w.do(ctx, req)
+	w.stderr.attach(nil)
+
+	if err != nil {
+		e.discard(w)
+		_ = output.Close(err)
+		return fmt.Errorf("formatter '%s' persistent worker failed: %w", e.command, err)
+	}
+
+	// return the worker to the pool
+	e.idle <- w
+
+	_, _ = output.Write([]byte(resp.Output))
+
+	if resp.ExitCode != 0 {
+		err = fmt.Errorf("exit status %d", resp.ExitCode)
+	}
+
+	if closeErr := output.Close(err); closeErr != nil {
+		e.log.Errorf("failed to close transcript: %v", closeErr)
+	}
+
+	if err != nil {
+		output.reportFailure(e.name)
+		return fmt.Errorf("formatter '%s' with options '%v' failed to apply: %w", e.command, e.options, err)
+	}
+
+	return nil
+}
+
+// Close shuts down all the workers in the pool concurrently, so that workers which do not exit only delay shutdown by
+// WorkerShutdownTimeout in total.
+func (e *workerEngine) Close() error {
+	e.lock.Lock()
+	all := e.all
+	e.all = nil
+	e.lock.Unlock()
+
+	errs := make([]error, len(all))
+
+	var wg sync.WaitGroup
+	for idx, w := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.close(); err != nil {
+				errs[idx] = fmt.Errorf("persistent worker %d did not exit cleanly: %w", w.cmd.Process.Pid, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -14,6 +14,9 @@ const (
 	Emitted
 	Matched
 	Formatted
+	Skipped
+	Reused
+	Renamed
 )
 
 var (
@@ -31,6 +34,9 @@ func Init() {
 	counters[Emitted] = &atomic.Int32{}
 	counters[Matched] = &atomic.Int32{}
 	counters[Formatted] = &atomic.Int32{}
+	counters[Skipped] = &atomic.Int32{}
+	counters[Reused] = &atomic.Int32{}
+	counters[Renamed] = &atomic.Int32{}
 }
 
 func Add(t Type, delta int32) int32 {
@@ -61,4 +67,16 @@ func Print() {
 		Value(Formatted),
 		Elapsed().Round(time.Millisecond),
 	)
+
+	if skipped := Value(Skipped); skipped > 0 {
+		fmt.Printf("skipped %d files due to their size or content\n", skipped)
+	}
+
+	if reused := Value(Reused); reused > 0 {
+		fmt.Printf("reused cached output for %d files\n", reused)
+	}
+
+	if renamed := Value(Renamed); renamed > 0 {
+		fmt.Printf("detected %d renamed files\n", renamed)
+	}
 }
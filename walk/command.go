@@ -0,0 +1,224 @@
+package walk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// Marker identifies a version control system or build tool by a directory in the tree root, along with the command
+// used to list the files it manages.
+type Marker struct {
+	Dir     string
+	Command []string
+}
+
+// Markers are checked in order when detecting which walker to use.
+var Markers = []Marker{
+	{Dir: ".jj", Command: []string{"jj", "file", "list"}},
+	{Dir: ".hg", Command: []string{"hg", "files", "-0"}},
+}
+
+type commandWalker struct {
+	root    string
+	paths   chan string
+	command []string
+
+	// optional, used to resolve symlinks
+	symlinks *symlinks
+	// optional, used to skip paths ignored by ignore files
+	excluder *ignorer
+}
+
+func (c commandWalker) Root() string {
+	return c.root
+}
+
+// SplitPaths returns a bufio.SplitFunc for a list of paths separated by NUL bytes or, if the first path is terminated by a
+// newline instead, by newlines.
+func SplitPaths() bufio.SplitFunc {
+	var sep byte
+	var detected bool
+
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if !detected {
+			if idx := bytes.IndexAny(data, "\x00\n"); idx >= 0 {
+				sep = data[idx]
+				detected = true
+			}
+		}
+
+		if detected {
+			if idx := bytes.IndexByte(data, sep); idx >= 0 {
+				return idx + 1, data[:idx], nil
+			}
+		}
+
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		// request more data
+		return 0, nil, nil
+	}
+}
+
+// list runs the command and returns the paths it lists, relative to the tree root.
+func (c commandWalker) list(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Dir = c.root
+	cmd.Stderr = os.Stderr
+
+	log.Debugf("listing files: %s", cmd.String())
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start walk command %v: %w", c.command, err)
+	}
+
+	var paths []string
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(SplitPaths())
+
+	for scanner.Scan() {
+		if path := scanner.Text(); path != "" {
+			paths = append(paths, filepath.Clean(filepath.FromSlash(path)))
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("failed to read output of walk command %v: %w", c.command, err)
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("walk command %v failed: %w", c.command, err)
+	}
+
+	return paths, nil
+}
+
+func (c commandWalker) Walk(ctx context.Context, fn WalkFunc) error {
+	// the command is only run once, the first time it is needed
+	var listed []string
+	var hasListed bool
+
+	for path := range c.paths {
+		if !hasListed {
+			var err error
+			if listed, err = c.list(ctx); err != nil {
+				return err
+			}
+			hasListed = true
+		}
+
+		relPath, err := filepath.Rel(c.root, path)
+		if err != nil {
+			return fmt.Errorf("failed to find relative path for %v: %w", path, err)
+		}
+
+		// only emit the listed files which are within the path we have been asked to walk
+		prefix := relPath + string(filepath.Separator)
+
+		produce := func(submit func(path string, relPath string) error) error {
+			for _, listedPath := range listed {
+				if !(relPath == "." || listedPath == relPath || strings.HasPrefix(listedPath, prefix)) {
+					continue
+				}
+
+				// skip anything ignored by an ignore file before stat'ing it
+				if c.excluder != nil {
+					excluded, err := c.excluder.IgnoredPath(listedPath, false)
+					if err != nil {
+						return fmt.Errorf("failed to check if %s is ignored: %w", listedPath, err)
+					} else if excluded {
+						continue
+					}
+				}
+
+				if err := submit(filepath.Join(c.root, listedPath), listedPath); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		err = statOrdered(ctx, produce, func(path string, relPath string, info fs.FileInfo, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Debugf("path %v does not exist, skipping", path)
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("failed to stat %s: %w", path, err)
+			} else if info.IsDir() {
+				return nil
+			} else if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+				return c.symlinks.follow(ctx, path, fn)
+			}
+
+			file := File{
+				Path:    path,
+				RelPath: relPath,
+				Info:    info,
+			}
+
+			return c.symlinks.emit(&file, fn)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detectCommand returns the command of the first marker present in root whose executable is available.
+func detectCommand(root string) []string {
+	for _, marker := range Markers {
+		if info, err := os.Stat(filepath.Join(root, marker.Dir)); err != nil || !info.IsDir() {
+			continue
+		}
+		if _, err := exec.LookPath(marker.Command[0]); err != nil {
+			log.Debugf("found %v but %v is not available", marker.Dir, marker.Command[0])
+			continue
+		}
+		return marker.Command
+	}
+	return nil
+}
+
+func NewCommand(root string, paths chan string, opts Options) (Walker, error) {
+	command := opts.Command
+	if len(command) == 0 {
+		if command = detectCommand(root); command == nil {
+			return nil, fmt.Errorf("no walk command has been configured or detected in %s", root)
+		}
+	}
+
+	walker := commandWalker{
+		root:     root,
+		paths:    paths,
+		command:  command,
+		excluder: newIgnoreFiles(root, opts.IgnoreFiles),
+	}
+
+	var err error
+	if walker.symlinks, err = newSymlinks(root, opts.Symlinks); err != nil {
+		return nil, err
+	}
+
+	return walker, nil
+}
@@ -0,0 +1,108 @@
+package walk
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.numtide.com/numtide/treefmt/test"
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPaths(t *testing.T) {
+	as := require.New(t)
+
+	split := func(input string) []string {
+		var paths []string
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		scanner.Split(SplitPaths())
+		for scanner.Scan() {
+			paths = append(paths, scanner.Text())
+		}
+		as.NoError(scanner.Err())
+		return paths
+	}
+
+	as.Equal([]string{"a", "b\nc", "d"}, split("a\x00b\nc\x00d\x00"))
+	as.Equal([]string{"a", "b c", "d"}, split("a\nb c\nd"))
+	as.Equal([]string{"a"}, split("a"))
+	as.Nil(split(""))
+}
+
+func TestCommandWalker(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+
+	walkPaths := func(opts Options, paths ...string) []string {
+		pathsCh := make(chan string, len(paths))
+		for _, path := range paths {
+			pathsCh <- path
+		}
+		close(pathsCh)
+
+		walker, err := New(Auto, tempDir, pathsCh, opts)
+		as.NoError(err)
+
+		var relPaths []string
+		as.NoError(walker.Walk(context.Background(), func(file *File, err error) error {
+			as.NoError(err)
+			relPaths = append(relPaths, file.RelPath)
+			return nil
+		}))
+		return relPaths
+	}
+
+	// a configured command is used when detecting, with missing files and directories skipped
+	opts := Options{Command: []string{"printf", `./go/main.go\0haskell/Foo.hs\0missing.txt\0elm\0haskell/Nested/Foo.hs\0`}}
+	as.Equal([]string{"go/main.go", "haskell/Foo.hs", "haskell/Nested/Foo.hs"}, walkPaths(opts, tempDir))
+
+	// explicit paths only emit the listed files within them
+	as.Equal(
+		[]string{"haskell/Foo.hs", "haskell/Nested/Foo.hs", "go/main.go"},
+		walkPaths(opts, filepath.Join(tempDir, "haskell"), filepath.Join(tempDir, "go/main.go")),
+	)
+
+	// a failing command is an error
+	pathsCh := make(chan string, 1)
+	pathsCh <- tempDir
+	close(pathsCh)
+
+	walker, err := NewCommand(tempDir, pathsCh, Options{Command: []string{"false"}})
+	as.NoError(err)
+	as.ErrorContains(walker.Walk(context.Background(), func(*File, error) error { return nil }), "walk command [false] failed")
+
+	// a marker directory selects its command, if available
+	binDir := t.TempDir()
+	script := "#!/bin/sh\nprintf 'yaml/test.yaml\\nrust/src/main.rs\\n'\n"
+	as.NoError(os.WriteFile(filepath.Join(binDir, "jj"), []byte(script), 0o755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	as.NoError(os.Mkdir(filepath.Join(tempDir, ".jj"), 0o755))
+	as.Equal([]string{"yaml/test.yaml", "rust/src/main.rs"}, walkPaths(Options{}, tempDir))
+
+	walker, err = Detect(tempDir, make(chan string), Options{})
+	as.NoError(err)
+	as.IsType(commandWalker{}, walker)
+
+	// git is preferred when it is colocated with another tool
+	_, err = git.PlainInit(tempDir, false)
+	as.NoError(err)
+
+	walker, err = Detect(tempDir, make(chan string), Options{})
+	as.NoError(err)
+	as.IsType(&gitWalker{}, walker)
+
+	// unless a command has been configured
+	walker, err = Detect(tempDir, make(chan string), Options{Command: []string{"jj", "file", "list"}})
+	as.NoError(err)
+	as.IsType(commandWalker{}, walker)
+
+	// otherwise it is an error to walk with a command
+	_, err = NewCommand(t.TempDir(), make(chan string), Options{})
+	as.ErrorContains(err, "no walk command has been configured or detected")
+}
@@ -6,12 +6,19 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+
+	"github.com/charmbracelet/log"
 )
 
 type filesystemWalker struct {
 	root          string
 	pathsCh       chan string
 	relPathOffset int
+
+	// optional, used to skip paths ignored by git or by ignore files
+	ignorers []*ignorer
+	// optional, used to resolve symlinks
+	symlinks *symlinks
 }
 
 func (f filesystemWalker) Root() string {
@@ -27,32 +34,55 @@ func (f filesystemWalker) relPath(path string) (string, error) {
 	return filepath.Rel(f.root, path)
 }
 
-func (f filesystemWalker) Walk(_ context.Context, fn WalkFunc) error {
+func (f filesystemWalker) Walk(ctx context.Context, fn WalkFunc) error {
 	walkFn := func(path string, info fs.FileInfo, _ error) error {
 		if info == nil {
 			return fmt.Errorf("no such file or directory '%s'", path)
 		}
 
-		// ignore directories and symlinks
-		if info.IsDir() || info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			return nil
-		}
-
 		relPath, err := f.relPath(path)
 		if err != nil {
 			return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
 		}
 
+		// skip anything ignored, without descending into ignored directories
+		for _, ignorer := range f.ignorers {
+			ignored, err := ignorer.Ignored(relPath, info.IsDir())
+			if err != nil {
+				return fmt.Errorf("failed to check if %s is ignored: %w", path, err)
+			} else if ignored && info.IsDir() {
+				return filepath.SkipDir
+			} else if ignored {
+				return nil
+			}
+		}
+
+		// ignore directories, and resolve symlinks according to the policy
+		if info.IsDir() {
+			return nil
+		} else if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return f.symlinks.follow(ctx, path, fn)
+		}
+
 		file := File{
 			Path:    path,
 			RelPath: relPath,
 			Info:    info,
 		}
-		return fn(&file, err)
+		return f.symlinks.emit(&file, fn)
 	}
 
 	for path := range f.pathsCh {
-		if err := filepath.Walk(path, walkFn); err != nil {
+		// check if the path we have been asked to walk, or any of its parents, are ignored
+		ignored, err := f.ignoredPath(path)
+		if err != nil {
+			return err
+		} else if ignored {
+			log.Debugf("path %v is ignored, skipping", path)
+			continue
+		}
+
+		if err := walkTree(ctx, path, walkFn); err != nil {
 			return err
 		}
 	}
@@ -60,10 +90,67 @@ func (f filesystemWalker) Walk(_ context.Context, fn WalkFunc) error {
 	return nil
 }
 
-func NewFilesystem(root string, paths chan string) (Walker, error) {
-	return filesystemWalker{
+// ignoredPath returns true if path, or any of its parents, are ignored.
+func (f filesystemWalker) ignoredPath(path string) (bool, error) {
+	if len(f.ignorers) == 0 {
+		return false, nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		// let the walk report the error
+		return false, nil
+	}
+
+	relPath, err := f.relPath(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
+	}
+
+	for _, ignorer := range f.ignorers {
+		ignored, err := ignorer.IgnoredPath(relPath, info.IsDir())
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+
+	return false, nil
+}
+
+func NewFilesystem(root string, paths chan string, opts Options) (Walker, error) {
+	walker := filesystemWalker{
 		root:          root,
 		pathsCh:       paths,
 		relPathOffset: len(root) + 1,
-	}, nil
+	}
+
+	var err error
+	if walker.symlinks, err = newSymlinks(root, opts.Symlinks); err != nil {
+		return nil, err
+	}
+
+	if walker.ignorers, err = newIgnorers(root, opts); err != nil {
+		return nil, err
+	}
+
+	return walker, nil
+}
+
+// newIgnorers returns the ignorers used to skip paths when walking the filesystem with the given options.
+func newIgnorers(root string, opts Options) ([]*ignorer, error) {
+	var ignorers []*ignorer
+
+	if !opts.NoGitignore {
+		ignorer, err := newIgnorer(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load gitignore files: %w", err)
+		}
+		ignorers = append(ignorers, ignorer)
+	}
+
+	if ignorer := newIgnoreFiles(root, opts.IgnoreFiles); ignorer != nil {
+		ignorers = append(ignorers, ignorer)
+	}
+
+	return ignorers, nil
 }
@@ -55,7 +55,7 @@ func TestFilesystemWalker_Walk(t *testing.T) {
 
 	as := require.New(t)
 
-	walker, err := NewFilesystem(tempDir, paths)
+	walker, err := NewFilesystem(tempDir, paths, Options{})
 	as.NoError(err)
 
 	idx := 0
@@ -2,14 +2,17 @@ package walk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/charmbracelet/log"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 )
 
 type gitWalker struct {
@@ -17,6 +20,17 @@ type gitWalker struct {
 	paths         chan string
 	repo          *git.Repository
 	relPathOffset int
+
+	// optional, used to find untracked files which are not ignored
+	ignorer *ignorer
+	// whether to walk the index of any submodules
+	recurseSubmodules bool
+	// optional, the names of config files which cause a submodule to be skipped when present at its root
+	submoduleConfigFiles []string
+	// optional, used to resolve symlinks
+	symlinks *symlinks
+	// optional, used to skip paths ignored by ignore files, whether they are tracked or not
+	excluder *ignorer
 }
 
 func (g gitWalker) Root() string {
@@ -32,62 +46,234 @@ func (g gitWalker) relPath(path string) (string, error) {
 	return filepath.Rel(g.root, path)
 }
 
-func (g gitWalker) Walk(ctx context.Context, fn WalkFunc) error {
-	idx, err := g.repo.Storer.Index()
+// isFile returns true for index entries which are regular or executable files, not directories, symlinks or
+// submodules. go-git does not consider executable files to be regular, so checking IsRegular alone would skip them once
+// they are tracked, despite them being walked whilst untracked.
+func isFile(mode filemode.FileMode) bool {
+	return mode.IsRegular() || mode == filemode.Executable
+}
+
+// walkIndex calls fn for each entry in the index of repo, with names relative to the tree root.
+// prefix is the path of repo relative to the tree root, which is empty for the tree itself.
+// Entries which have been excluded from a sparse checkout, either with the skip-worktree bit or the sparse-checkout
+// patterns, are passed with a mode of filemode.Empty.
+// If enabled, the index of each initialised submodule is walked after its gitlink entry, unless it has its own config.
+func (g gitWalker) walkIndex(
+	repo *git.Repository,
+	prefix string,
+	fn func(name string, mode filemode.FileMode) error,
+) error {
+	idx, err := repo.Storer.Index()
 	if err != nil {
 		return fmt.Errorf("failed to open git index: %w", err)
 	}
 
-	// cache in-memory whether a path is present in the git index
-	var cache map[string]bool
+	sparse, err := sparseMatcher(repo, filepath.Join(g.root, prefix))
+	if err != nil {
+		return fmt.Errorf("failed to load sparse-checkout patterns: %w", err)
+	}
 
-	for path := range g.paths {
+	for _, entry := range idx.Entries {
+		name := filepath.Join(prefix, filepath.FromSlash(entry.Name))
 
-		if path == g.root {
-			// we can just iterate the index entries
-			for _, entry := range idx.Entries {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-					// we only want regular files, not directories or symlinks
-					if !entry.Mode.IsRegular() {
-						continue
-					}
+		mode := entry.Mode
+		if entry.SkipWorktree || (sparse != nil && !sparse.Match(strings.Split(entry.Name, "/"), false)) {
+			mode = filemode.Empty
+		}
 
-					// stat the file
-					path := filepath.Join(g.root, entry.Name)
+		if err = fn(name, mode); err != nil {
+			return err
+		}
 
-					info, err := os.Lstat(path)
-					if err != nil {
-						return fmt.Errorf("failed to stat %s: %w", path, err)
-					}
+		if !(mode == filemode.Submodule && g.recurseSubmodules) || g.ownConfig(name) {
+			continue
+		}
+
+		submodule, err := openRepo(filepath.Join(g.root, name))
+		if errors.Is(err, git.ErrRepositoryNotExists) {
+			log.Debugf("submodule %v has not been initialised, skipping", name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to open submodule %v: %w", name, err)
+		}
+
+		if err = g.walkIndex(submodule, name, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownConfig returns true if the submodule at relPath contains one of the submodule config files at its root, in which
+// case it is formatted as a separate tree rather than walked as part of this one.
+func (g gitWalker) ownConfig(relPath string) bool {
+	for _, name := range g.submoduleConfigFiles {
+		if _, err := os.Stat(filepath.Join(g.root, relPath, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// indexed returns the mode of every path present in the git index, including submodules if enabled.
+// Paths which have been excluded from a sparse checkout have a mode of filemode.Empty.
+func (g gitWalker) indexed() (map[string]filemode.FileMode, error) {
+	cache := make(map[string]filemode.FileMode)
+	err := g.walkIndex(g.repo, "", func(name string, mode filemode.FileMode) error {
+		cache[name] = mode
+		return nil
+	})
+	return cache, err
+}
+
+// inSubmodule returns true if relPath is within a submodule of the tree.
+func inSubmodule(cache map[string]filemode.FileMode, relPath string) bool {
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		if cache[dir] == filemode.Submodule {
+			return true
+		}
+	}
+	return false
+}
+
+// walkUntracked walks the filesystem starting at path, emitting any files which are not in the git index and are not
+// ignored. Ignored directories and submodules are not descended into.
+func (g gitWalker) walkUntracked(
+	ctx context.Context,
+	path string,
+	cache map[string]filemode.FileMode,
+	fn WalkFunc,
+) error {
+	return walkTree(ctx, path, func(path string, info fs.FileInfo, _ error) error {
+		if info == nil {
+			return fmt.Errorf("no such file or directory '%s'", path)
+		}
+
+		relPath, err := g.relPath(path)
+		if err != nil {
+			return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
+		}
+
+		// skip submodules, which are walked using their own index
+		if mode, ok := cache[relPath]; ok && mode == filemode.Submodule {
+			return filepath.SkipDir
+		}
+
+		// skip tracked files
+		if _, ok := cache[relPath]; ok {
+			return nil
+		}
+
+		ignored, err := g.ignorer.Ignored(relPath, info.IsDir())
+		if err == nil && !ignored && g.excluder != nil {
+			ignored, err = g.excluder.Ignored(relPath, info.IsDir())
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to check if %s is ignored: %w", path, err)
+		} else if ignored && info.IsDir() {
+			return filepath.SkipDir
+		} else if ignored || info.IsDir() {
+			return nil
+		} else if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return g.symlinks.follow(ctx, path, fn)
+		}
+
+		file := File{
+			Path:    path,
+			RelPath: relPath,
+			Info:    info,
+		}
+
+		return g.symlinks.emit(&file, fn)
+	})
+}
+
+// excluded returns true if relPath, or any of its parents, are ignored by an ignore file.
+func (g gitWalker) excluded(relPath string, isDir bool) (bool, error) {
+	if g.excluder == nil {
+		return false, nil
+	}
+	excluded, err := g.excluder.IgnoredPath(relPath, isDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if %s is ignored: %w", relPath, err)
+	}
+	return excluded, nil
+}
 
-					// determine a relative path
-					relPath, err := g.relPath(path)
-					if err != nil {
-						return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
+func (g gitWalker) Walk(ctx context.Context, fn WalkFunc) error {
+	// cache in-memory the mode of each path present in the git index
+	var cache map[string]filemode.FileMode
+
+	for path := range g.paths {
+
+		if path == g.root {
+			// populate the cache whilst iterating the index, if we haven't already
+			populate := cache == nil
+			if populate {
+				cache = make(map[string]filemode.FileMode)
+			}
+
+			// we can just iterate the index entries, stat'ing them in the background
+			produce := func(submit func(path string, relPath string) error) error {
+				return g.walkIndex(g.repo, "", func(name string, mode filemode.FileMode) error {
+					if populate {
+						cache[name] = mode
 					}
 
-					file := File{
-						Path:    path,
-						RelPath: relPath,
-						Info:    info,
+					// we only want regular or executable files, not directories, submodules or files which are not
+					// checked out, and symlinks only if they are to be resolved
+					if !(isFile(mode) || (mode == filemode.Symlink && g.symlinks != nil)) {
+						return nil
 					}
 
-					if err = fn(&file, err); err != nil {
+					// skip anything ignored by an ignore file before stat'ing it
+					if excluded, err := g.excluded(name, false); err != nil || excluded {
 						return err
 					}
+
+					return submit(filepath.Join(g.root, name), name)
+				})
+			}
+
+			err := statOrdered(ctx, produce, func(path string, relPath string, info fs.FileInfo, err error) error {
+				if errors.Is(err, fs.ErrNotExist) {
+					log.Debugf("path %v has been removed from the worktree, skipping", path)
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("failed to stat %s: %w", path, err)
+				} else if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+					return g.symlinks.follow(ctx, path, fn)
+				}
+
+				file := File{
+					Path:    path,
+					RelPath: relPath,
+					Info:    info,
+				}
+
+				return g.symlinks.emit(&file, fn)
+			})
+			if err != nil {
+				return err
+			}
+
+			// then walk the filesystem for any untracked files
+			if g.ignorer != nil {
+				if err = g.walkUntracked(ctx, g.root, cache, fn); err != nil {
+					return err
 				}
 			}
+
 			continue
 		}
 
 		// otherwise we ensure the git index entries are cached and then check if they are in the git index
 		if cache == nil {
-			cache = make(map[string]bool)
-			for _, entry := range idx.Entries {
-				cache[entry.Name] = true
+			var err error
+			if cache, err = g.indexed(); err != nil {
+				return err
 			}
 		}
 
@@ -97,14 +283,23 @@ func (g gitWalker) Walk(ctx context.Context, fn WalkFunc) error {
 		}
 
 		_, ok := cache[relPath]
-		if !(path == g.root || ok) {
+		if !(path == g.root || ok || g.ignorer != nil) {
 			log.Debugf("path %v not found in git index, skipping", path)
 			continue
 		}
 
-		return filepath.Walk(path, func(path string, info fs.FileInfo, _ error) error {
-			if info.IsDir() {
-				return nil
+		if info, err := os.Lstat(path); err == nil {
+			if excluded, err := g.excluded(relPath, info.IsDir()); err != nil {
+				return err
+			} else if excluded {
+				log.Debugf("path %v is ignored, skipping", path)
+				continue
+			}
+		}
+
+		err = walkTree(ctx, path, func(path string, info fs.FileInfo, _ error) error {
+			if info == nil {
+				return fmt.Errorf("no such file or directory '%s'", path)
 			}
 
 			relPath, err := g.relPath(path)
@@ -112,9 +307,50 @@ func (g gitWalker) Walk(ctx context.Context, fn WalkFunc) error {
 				return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
 			}
 
-			if _, ok := cache[relPath]; !ok {
-				log.Debugf("path %v not found in git index, skipping", path)
+			// skip anything ignored by an ignore file, without descending into ignored directories
+			if g.excluder != nil {
+				excluded, err := g.excluder.Ignored(relPath, info.IsDir())
+				if err != nil {
+					return fmt.Errorf("failed to check if %s is ignored: %w", path, err)
+				} else if excluded && info.IsDir() {
+					return filepath.SkipDir
+				} else if excluded {
+					return nil
+				}
+			}
+
+			if info.IsDir() {
+				// never descend into the .git directory, or submodules unless enabled and they do not have their own config
+				if info.Name() == gitDir {
+					return filepath.SkipDir
+				} else if cache[relPath] == filemode.Submodule && (!g.recurseSubmodules || g.ownConfig(relPath)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			isSymlink := info.Mode()&os.ModeSymlink == os.ModeSymlink
+
+			if mode, ok := cache[relPath]; ok && !(isFile(mode) || (isSymlink && mode == filemode.Symlink)) {
 				return nil
+			} else if !ok {
+				if g.ignorer == nil || inSubmodule(cache, relPath) {
+					log.Debugf("path %v not found in git index, skipping", path)
+					return nil
+				}
+
+				// an untracked file, which we only want if it is not ignored
+				ignored, err := g.ignorer.IgnoredPath(relPath, false)
+				if err != nil {
+					return fmt.Errorf("failed to check if %s is ignored: %w", path, err)
+				} else if ignored {
+					log.Debugf("path %v is untracked and ignored by git, skipping", path)
+					return nil
+				}
+			}
+
+			if isSymlink {
+				return g.symlinks.follow(ctx, path, fn)
 			}
 
 			file := File{
@@ -123,22 +359,69 @@ func (g gitWalker) Walk(ctx context.Context, fn WalkFunc) error {
 				Info:    info,
 			}
 
-			return fn(&file, err)
+			return g.symlinks.emit(&file, fn)
 		})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func NewGit(root string, paths chan string) (Walker, error) {
-	repo, err := git.PlainOpen(root)
+func NewGit(root string, paths chan string, opts Options) (Walker, error) {
+	repo, err := openRepo(root)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open git repo: %w", err)
 	}
-	return &gitWalker{
-		root:          root,
-		paths:         paths,
-		repo:          repo,
-		relPathOffset: len(root) + 1,
-	}, nil
+
+	walker := &gitWalker{
+		root:                 root,
+		paths:                paths,
+		repo:                 repo,
+		relPathOffset:        len(root) + 1,
+		recurseSubmodules:    opts.RecurseSubmodules,
+		submoduleConfigFiles: opts.SubmoduleConfigFiles,
+		excluder:             newIgnoreFiles(root, opts.IgnoreFiles),
+	}
+
+	if walker.symlinks, err = newSymlinks(root, opts.Symlinks); err != nil {
+		return nil, err
+	}
+
+	if !opts.NoUntracked {
+		if walker.ignorer, err = newIgnorer(root); err != nil {
+			return nil, fmt.Errorf("failed to load gitignore files: %w", err)
+		}
+	}
+
+	return walker, nil
+}
+
+// ConfiguredSubmodules returns the paths, relative to root, of the initialised submodules of the git repository at root
+// which contain one of configFiles at their root. Submodules without their own config are searched recursively, but
+// those with their own config are not. If root is not a git repository, it returns nil.
+func ConfiguredSubmodules(root string, configFiles []string) ([]string, error) {
+	repo, err := openRepo(root)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open git repo: %w", err)
+	}
+
+	walker := gitWalker{
+		root:                 root,
+		recurseSubmodules:    true,
+		submoduleConfigFiles: configFiles,
+	}
+
+	var submodules []string
+	err = walker.walkIndex(repo, "", func(name string, mode filemode.FileMode) error {
+		if mode == filemode.Submodule && walker.ownConfig(name) {
+			submodules = append(submodules, name)
+		}
+		return nil
+	})
+
+	return submodules, err
 }
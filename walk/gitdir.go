@@ -0,0 +1,94 @@
+package walk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	gitDirPrefix   = "gitdir:"
+	commonDirFile  = "commondir"
+	sparseCheckout = "sparse-checkout"
+)
+
+// resolveGitDir returns the git directory for the worktree at root, and the common directory it shares with any other
+// worktrees. A .git file, as used by linked worktrees and submodules, is followed to the directory it points at.
+// If root does not contain a .git entry, both are empty.
+func resolveGitDir(root string) (dir string, commonDir string, err error) {
+	dir = filepath.Join(root, gitDir)
+
+	info, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+
+	if !info.IsDir() {
+		b, err := os.ReadFile(dir)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+
+		line := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(line, gitDirPrefix) {
+			return "", "", fmt.Errorf("%s is not a valid .git file", dir)
+		}
+
+		dir = strings.TrimSpace(strings.TrimPrefix(line, gitDirPrefix))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(root, dir)
+		}
+	}
+
+	// linked worktrees share most of their state with the main worktree
+	commonDir = dir
+	b, err := os.ReadFile(filepath.Join(dir, commonDirFile))
+	if err == nil {
+		commonDir = strings.TrimSpace(string(b))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(dir, commonDir)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", "", fmt.Errorf("failed to read common dir for %s: %w", dir, err)
+	}
+
+	return dir, commonDir, nil
+}
+
+// openRepo opens the git repository for the worktree at root, which may be a linked worktree or a submodule.
+func openRepo(root string) (*git.Repository, error) {
+	return git.PlainOpenWithOptions(root, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+}
+
+// sparseMatcher returns a matcher for the sparse-checkout patterns of the repository at root, which reports true for
+// paths which are checked out. If sparse checkout has not been enabled, it returns nil.
+func sparseMatcher(repo *git.Repository, root string) (gitignore.Matcher, error) {
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git config: %w", err)
+	}
+
+	if cfg.Raw.Section("core").Option("sparseCheckout") != "true" {
+		return nil, nil
+	}
+
+	dir, _, err := resolveGitDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns, err := readIgnoreFile(filepath.Join(dir, "info", sparseCheckout), nil)
+	if err != nil || len(patterns) == 0 {
+		return nil, err
+	}
+
+	return gitignore.NewMatcher(patterns), nil
+}
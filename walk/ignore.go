@@ -0,0 +1,265 @@
+package walk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/adrg/xdg"
+	"github.com/charmbracelet/log"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	gitDir        = ".git"
+	gitignoreFile = ".gitignore"
+
+	// TreefmtIgnoreFile is the name of the ignore files which are always respected when walking.
+	TreefmtIgnoreFile = ".treefmtignore"
+)
+
+// ignorer determines whether paths within root should be ignored, in the same way git does.
+// It respects ignore files with the given names at any level, on top of a set of base patterns.
+// The ignore files for a directory are read the first time a path within it is checked.
+type ignorer struct {
+	root  string
+	base  []gitignore.Pattern
+	names []string
+	// whether the .git directory is always ignored
+	git bool
+
+	lock sync.Mutex
+	dirs map[string][]gitignore.Pattern
+}
+
+// newIgnorer returns an ignorer which respects .gitignore files at any level, .git/info/exclude and the global and
+// system gitignore files.
+func newIgnorer(root string) (*ignorer, error) {
+	rootFs := osfs.New("/")
+
+	// the lowest priority patterns come first
+	var base []gitignore.Pattern
+
+	system, err := gitignore.LoadSystemPatterns(rootFs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load system gitignore: %w", err)
+	}
+	base = append(base, system...)
+
+	global, err := gitignore.LoadGlobalPatterns(rootFs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load global gitignore: %w", err)
+	}
+
+	// git defaults to $XDG_CONFIG_HOME/git/ignore when core.excludesFile has not been set
+	if global == nil {
+		if global, err = readIgnoreFile(filepath.Join(xdg.ConfigHome, "git", "ignore"), nil); err != nil {
+			return nil, err
+		}
+	}
+	base = append(base, global...)
+
+	// the exclude file is shared by linked worktrees
+	_, commonDir, err := resolveGitDir(root)
+	if err != nil {
+		return nil, err
+	} else if commonDir != "" {
+		exclude, err := readIgnoreFile(filepath.Join(commonDir, "info", "exclude"), nil)
+		if err != nil {
+			return nil, err
+		}
+		base = append(base, exclude...)
+	}
+
+	return &ignorer{
+		root:  root,
+		base:  base,
+		names: []string{gitignoreFile},
+		git:   true,
+		dirs:  make(map[string][]gitignore.Pattern),
+	}, nil
+}
+
+// newIgnoreFiles returns an ignorer which respects ignore files with the given names at any level, or nil if there are
+// no names.
+func newIgnoreFiles(root string, names []string) *ignorer {
+	if len(names) == 0 {
+		return nil
+	}
+	return &ignorer{
+		root:  root,
+		names: names,
+		dirs:  make(map[string][]gitignore.Pattern),
+	}
+}
+
+// IgnoreFiles matches paths which are ignored by ignore files, such as .treefmtignore or .prettierignore, using
+// .gitignore syntax.
+type IgnoreFiles struct {
+	ignorer *ignorer
+}
+
+// NewIgnoreFiles returns an IgnoreFiles which respects ignore files with the given names at any level within root.
+func NewIgnoreFiles(root string, names []string) *IgnoreFiles {
+	return &IgnoreFiles{ignorer: newIgnoreFiles(root, names)}
+}
+
+// Matches returns true if relPath, or any of its parent directories, is ignored.
+// Ignore files which cannot be read are logged and treated as empty.
+func (i *IgnoreFiles) Matches(relPath string) bool {
+	if i.ignorer == nil {
+		return false
+	}
+	ignored, err := i.ignorer.IgnoredPath(relPath, false)
+	if err != nil {
+		log.Warnf("failed to check if %s is ignored: %v", relPath, err)
+	}
+	return ignored
+}
+
+// Ignorer determines whether paths within a tree are skipped when walking the filesystem, because they are ignored by
+// git or by ignore files.
+type Ignorer struct {
+	ignorers []*ignorer
+}
+
+// NewIgnorer returns an Ignorer which skips the same paths within root as the filesystem walker does with opts.
+func NewIgnorer(root string, opts Options) (*Ignorer, error) {
+	ignorers, err := newIgnorers(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Ignorer{ignorers: ignorers}, nil
+}
+
+// Ignored returns true if relPath should be skipped. As when walking, it does not check whether any of the parent
+// directories of relPath are ignored.
+func (i *Ignorer) Ignored(relPath string, isDir bool) (bool, error) {
+	for _, ignorer := range i.ignorers {
+		ignored, err := ignorer.Ignored(relPath, isDir)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
+
+// readIgnoreFile parses the patterns in a gitignore file, relative to domain. A missing file is not an error.
+func readIgnoreFile(path string, domain []string) ([]gitignore.Pattern, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open ignore file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var patterns []gitignore.Pattern
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, domain))
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file %s: %w", path, err)
+	}
+
+	return patterns, nil
+}
+
+// splitPath splits a relative path into its components, with "." resulting in no components.
+func splitPath(relPath string) []string {
+	if relPath == "." || relPath == "" {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(relPath), "/")
+}
+
+// patterns returns the patterns which apply to entries within relDir, in ascending order of priority.
+// The caller must hold the lock.
+func (i *ignorer) patterns(relDir string) ([]gitignore.Pattern, error) {
+	if relDir == "" {
+		relDir = "."
+	}
+
+	if ps, ok := i.dirs[relDir]; ok {
+		return ps, nil
+	}
+
+	var parent []gitignore.Pattern
+	if relDir == "." {
+		parent = i.base
+	} else {
+		var err error
+		if parent, err = i.patterns(filepath.Dir(relDir)); err != nil {
+			return nil, err
+		}
+	}
+
+	var own []gitignore.Pattern
+	for _, name := range i.names {
+		ps, err := readIgnoreFile(filepath.Join(i.root, relDir, name), splitPath(relDir))
+		if err != nil {
+			return nil, err
+		}
+		own = append(own, ps...)
+	}
+
+	// copy to avoid sharing the backing array with siblings
+	ps := make([]gitignore.Pattern, 0, len(parent)+len(own))
+	ps = append(ps, parent...)
+	ps = append(ps, own...)
+
+	i.dirs[relDir] = ps
+	return ps, nil
+}
+
+// Ignored returns true if relPath should be ignored. It does not check whether any of the parent directories of
+// relPath are ignored, so it is intended to be used whilst walking, where ignored directories are skipped.
+func (i *ignorer) Ignored(relPath string, isDir bool) (bool, error) {
+	// never ignore the root, or paths outside of it
+	if relPath == "." || relPath == "" || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return false, nil
+	}
+
+	parts := splitPath(relPath)
+
+	// the .git directory is always ignored by git
+	if i.git && parts[len(parts)-1] == gitDir {
+		return true, nil
+	}
+
+	i.lock.Lock()
+	ps, err := i.patterns(filepath.Dir(relPath))
+	i.lock.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	return gitignore.NewMatcher(ps).Match(parts, isDir), nil
+}
+
+// IgnoredPath returns true if relPath, or any of its parent directories, should be ignored.
+func (i *ignorer) IgnoredPath(relPath string, isDir bool) (bool, error) {
+	parts := splitPath(relPath)
+	for idx := range parts {
+		last := idx == len(parts)-1
+		ignored, err := i.Ignored(filepath.Join(parts[:idx+1]...), !last || isDir)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,258 @@
+package walk
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// statWindow is the maximum number of stat results per worker which can be pending before they are emitted.
+const statWindow = 256
+
+// workers is the number of goroutines used to read directories and stat files.
+var workers = runtime.NumCPU()
+
+// statRequest is a path to be stat'd in the background.
+type statRequest struct {
+	path    string
+	relPath string
+
+	info fs.FileInfo
+	err  error
+	done chan struct{}
+}
+
+// statOrdered stats the paths submitted by produce using a pool of workers, calling fn with each result in the order in
+// which they were submitted. fn is called from the calling goroutine, and never concurrently.
+// At most statWindow results per worker are held in memory at any one time.
+func statOrdered(
+	ctx context.Context,
+	produce func(submit func(path string, relPath string) error) error,
+	fn func(path string, relPath string, info fs.FileInfo, err error) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	queue := make(chan *statRequest, workers*statWindow)
+	work := make(chan *statRequest, workers*statWindow)
+
+	eg.Go(func() error {
+		defer close(queue)
+		defer close(work)
+
+		return produce(func(path string, relPath string) error {
+			req := &statRequest{path: path, relPath: relPath, done: make(chan struct{})}
+			// the queue preserves ordering, so it must be sent to first
+			for _, ch := range []chan *statRequest{queue, work} {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ch <- req:
+				}
+			}
+			return nil
+		})
+	})
+
+	for i := 0; i < workers; i++ {
+		eg.Go(func() error {
+			for req := range work {
+				req.info, req.err = os.Lstat(req.path)
+				close(req.done)
+			}
+			return nil
+		})
+	}
+
+	for req := range queue {
+		select {
+		case <-ctx.Done():
+			return eg.Wait()
+		case <-req.done:
+		}
+
+		if err := fn(req.path, req.relPath, req.info, req.err); err != nil {
+			cancel()
+			_ = eg.Wait()
+			return err
+		}
+	}
+
+	return eg.Wait()
+}
+
+// listingWindow is the maximum number of directory listings per worker which can be read ahead of the walk.
+const listingWindow = 4
+
+// listing is the contents of a directory, read ahead of the walk.
+type listing struct {
+	infos []fs.FileInfo
+	err   error
+	done  chan struct{}
+}
+
+// readDir returns the file info for each entry in the directory at path, sorted by name.
+func readDir(path string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed since the directory was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// treeWalker walks a directory tree in lexical order, reading the directories ahead of the walk in the background.
+type treeWalker struct {
+	ctx context.Context
+	fn  filepath.WalkFunc
+
+	// bounds the number of listings which are held in memory, waiting to be walked
+	tokens chan struct{}
+}
+
+// walkTree is equivalent to filepath.Walk, except that directories are read and their entries stat'd by a pool of
+// workers, ahead of the walk. Paths are visited in the same order, and fn is never called concurrently.
+// To avoid reading directories which are going to be skipped, fn is called for a directory when its parent is read,
+// before its preceding siblings are visited.
+func walkTree(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	t := treeWalker{
+		ctx:    ctx,
+		fn:     fn,
+		tokens: make(chan struct{}, workers*listingWindow),
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else if err = fn(root, info, nil); err == nil && info.IsDir() {
+		err = t.walkDir(root, info, nil)
+	}
+
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// readAhead starts reading the directory at path in the background, returning nil if too many listings are already
+// held in memory, in which case the directory will be read when it is walked.
+func (t *treeWalker) readAhead(path string) *listing {
+	select {
+	case t.tokens <- struct{}{}:
+	default:
+		return nil
+	}
+
+	l := &listing{done: make(chan struct{})}
+	go func() {
+		l.infos, l.err = readDir(path)
+		close(l.done)
+	}()
+	return l
+}
+
+// release waits for a listing to be read and then frees its place in the window.
+func (t *treeWalker) release(l *listing) {
+	if l != nil {
+		<-l.done
+		<-t.tokens
+	}
+}
+
+// walkDir visits the contents of the directory at path, which has already been visited.
+func (t *treeWalker) walkDir(path string, info fs.FileInfo, l *listing) error {
+	select {
+	case <-t.ctx.Done():
+		t.release(l)
+		return t.ctx.Err()
+	default:
+	}
+
+	var infos []fs.FileInfo
+	var err error
+
+	if l != nil {
+		t.release(l)
+		infos, err = l.infos, l.err
+	} else {
+		infos, err = readDir(path)
+	}
+
+	if err != nil {
+		return t.fn(path, info, err)
+	}
+
+	// visit each sub directory, and read ahead any which have not been skipped
+	listings := make([]*listing, len(infos))
+	skipped := make([]bool, len(infos))
+
+	releaseAll := func() {
+		for _, l := range listings {
+			t.release(l)
+		}
+	}
+
+	for idx, child := range infos {
+		if !child.IsDir() {
+			continue
+		}
+
+		childPath := filepath.Join(path, child.Name())
+		if err = t.fn(childPath, child, nil); errors.Is(err, filepath.SkipDir) {
+			skipped[idx] = true
+		} else if err != nil {
+			releaseAll()
+			return err
+		} else {
+			listings[idx] = t.readAhead(childPath)
+		}
+	}
+
+	for idx, child := range infos {
+		childPath := filepath.Join(path, child.Name())
+
+		if child.IsDir() {
+			if skipped[idx] {
+				continue
+			}
+			l := listings[idx]
+			listings[idx] = nil
+			err = t.walkDir(childPath, child, l)
+		} else {
+			err = t.fn(childPath, child, nil)
+		}
+
+		if errors.Is(err, filepath.SkipDir) {
+			if child.IsDir() {
+				continue
+			}
+			// skip the remaining entries in this directory
+			releaseAll()
+			return nil
+		} else if err != nil {
+			releaseAll()
+			return err
+		}
+	}
+
+	return nil
+}
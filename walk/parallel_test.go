@@ -0,0 +1,104 @@
+package walk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.numtide.com/numtide/treefmt/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkTree(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+
+	// create a wide tree, so that reading ahead is limited by the window
+	for i := 0; i < workers*listingWindow*2; i++ {
+		dir := filepath.Join(tempDir, "wide", fmt.Sprintf("%03d", i))
+		as.NoError(os.MkdirAll(dir, 0o755))
+		as.NoError(os.WriteFile(filepath.Join(dir, "file"), []byte{}, 0o644))
+	}
+
+	collect := func(walk func(string, filepath.WalkFunc) error) []string {
+		var paths []string
+		as.NoError(walk(tempDir, func(path string, info fs.FileInfo, err error) error {
+			as.NoError(err)
+			if info.IsDir() && info.Name() == "haskell" {
+				return filepath.SkipDir
+			} else if !info.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		}))
+		return paths
+	}
+
+	expected := collect(filepath.Walk)
+	actual := collect(func(root string, fn filepath.WalkFunc) error {
+		return walkTree(context.Background(), root, fn)
+	})
+
+	as.Len(actual, 25+workers*listingWindow*2)
+	as.Equal(expected, actual)
+
+	// errors returned by fn stop the walk
+	stop := errors.New("stop")
+	visited := 0
+	err := walkTree(context.Background(), tempDir, func(path string, info fs.FileInfo, err error) error {
+		if !info.IsDir() {
+			visited++
+			if visited == 10 {
+				return stop
+			}
+		}
+		return nil
+	})
+	as.ErrorIs(err, stop)
+	as.Equal(10, visited)
+
+	// as does a cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	as.ErrorIs(walkTree(ctx, tempDir, func(string, fs.FileInfo, error) error { return nil }), context.Canceled)
+}
+
+func TestStatOrdered(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+
+	produce := func(submit func(path string, relPath string) error) error {
+		// submit more paths than fit in the window
+		for i := 0; i < workers*statWindow*2; i++ {
+			relPath := examplesPaths[i%len(examplesPaths)]
+			if err := submit(filepath.Join(tempDir, relPath), relPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	idx := 0
+	err := statOrdered(context.Background(), produce, func(path string, relPath string, info fs.FileInfo, err error) error {
+		as.NoError(err)
+		as.Equal(examplesPaths[idx%len(examplesPaths)], relPath)
+		as.Equal(filepath.Base(relPath), info.Name())
+		idx++
+		return nil
+	})
+	as.NoError(err)
+	as.Equal(workers*statWindow*2, idx)
+
+	// errors returned by fn stop the producer
+	stop := errors.New("stop")
+	err = statOrdered(context.Background(), produce, func(string, string, fs.FileInfo, error) error {
+		return stop
+	})
+	as.ErrorIs(err, stop)
+}
@@ -0,0 +1,172 @@
+package walk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// SymlinkPolicy determines how symlinks are handled when walking.
+type SymlinkPolicy string
+
+const (
+	// SymlinkSkip ignores symlinks entirely.
+	SymlinkSkip SymlinkPolicy = "skip"
+	// SymlinkFollow resolves symlinks, wherever their target is.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkTargetInTree resolves symlinks whose target is within the tree root, ignoring the rest.
+	SymlinkTargetInTree SymlinkPolicy = "target-in-tree"
+)
+
+// symlinks resolves the symlinks encountered whilst walking according to a policy.
+// Files are emitted through their real path, and only once, no matter how many symlinks point to them.
+// It is not safe for concurrent use, and relies on a walker emitting files from a single goroutine.
+type symlinks struct {
+	policy   SymlinkPolicy
+	root     string
+	realRoot string
+
+	// paths relative to the real root of the files which have been emitted
+	seen map[string]bool
+	// real paths of the directories which have been followed
+	dirs map[string]bool
+}
+
+// newSymlinks returns nil for the skip policy, in which case symlinks are not resolved and files are not deduplicated.
+func newSymlinks(root string, policy SymlinkPolicy) (*symlinks, error) {
+	switch policy {
+	case "", SymlinkSkip:
+		return nil, nil
+	case SymlinkFollow, SymlinkTargetInTree:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy: %v", policy)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve tree root %s: %w", root, err)
+	}
+
+	return &symlinks{
+		policy:   policy,
+		root:     root,
+		realRoot: realRoot,
+		seen:     make(map[string]bool),
+		dirs:     make(map[string]bool),
+	}, nil
+}
+
+// emit calls fn with file, unless it has already been emitted.
+func (s *symlinks) emit(file *File, fn WalkFunc) error {
+	return s.emitAs(file.RelPath, file, fn)
+}
+
+// emitAs calls fn with file, unless a file with the same key, its path relative to the real root, has already been
+// emitted.
+func (s *symlinks) emitAs(key string, file *File, fn WalkFunc) error {
+	if s != nil {
+		if s.seen[key] {
+			log.Debugf("path %v has already been emitted, skipping", file.Path)
+			return nil
+		}
+		s.seen[key] = true
+	}
+	return fn(file, nil)
+}
+
+// resolve returns the path of real relative to the real root, and whether it is within the tree root.
+func (s *symlinks) resolve(real string) (key string, inTree bool, err error) {
+	if key, err = filepath.Rel(s.realRoot, real); err != nil {
+		return "", false, fmt.Errorf("failed to determine a relative path for %s: %w", real, err)
+	}
+	return key, !(key == ".." || strings.HasPrefix(key, ".."+string(filepath.Separator))), nil
+}
+
+// target emits the file at real, which was found through the symlink at link.
+// Files within the tree root are emitted through their own path, whilst files outside it are emitted relative to the
+// tree root through the path of the link, so that relative paths never leave the tree root.
+func (s *symlinks) target(link string, real string, info fs.FileInfo, fn WalkFunc) error {
+	key, inTree, err := s.resolve(real)
+	if err != nil {
+		return err
+	}
+
+	file := &File{Path: real, Info: info, Link: link}
+	if inTree {
+		file.Path = filepath.Join(s.root, key)
+		file.RelPath = key
+	} else if file.RelPath, err = filepath.Rel(s.root, link); err != nil {
+		return fmt.Errorf("failed to determine a relative path for %s: %w", link, err)
+	}
+
+	return s.emitAs(key, file, fn)
+}
+
+// follow resolves the symlink at path, emitting its target if it is a file, or the files within it if it is a
+// directory. The contents of a directory within the tree root may also be walked directly, in which case each file is
+// only emitted once. Dangling symlinks and cycles are skipped.
+func (s *symlinks) follow(ctx context.Context, link string, fn WalkFunc) error {
+	if s == nil {
+		return nil
+	}
+
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		log.Debugf("failed to resolve symlink %v, skipping: %v", link, err)
+		return nil
+	}
+
+	if _, inTree, err := s.resolve(real); err != nil {
+		return err
+	} else if !inTree && s.policy != SymlinkFollow {
+		log.Debugf("symlink %v points outside the tree root, skipping", link)
+		return nil
+	}
+
+	info, err := os.Stat(real)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", real, err)
+	}
+
+	if !info.IsDir() {
+		return s.target(link, real, info, fn)
+	}
+
+	if s.dirs[real] {
+		log.Debugf("symlink %v points to a directory which has already been followed, skipping", link)
+		return nil
+	}
+	s.dirs[real] = true
+
+	return walkTree(ctx, real, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			if info.Name() == gitDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// determine the path through the symlink
+		rel, err := filepath.Rel(real, path)
+		if err != nil {
+			return fmt.Errorf("failed to determine a relative path for %s: %w", path, err)
+		}
+		linkPath := filepath.Join(link, rel)
+
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return s.follow(ctx, linkPath, fn)
+		}
+
+		return s.target(linkPath, path, info, fn)
+	})
+}
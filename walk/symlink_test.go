@@ -0,0 +1,88 @@
+package walk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.numtide.com/numtide/treefmt/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymlinks(t *testing.T) {
+	as := require.New(t)
+
+	tempDir := test.TempExamples(t)
+
+	// a directory outside the tree, containing a cycle
+	outsideDir := t.TempDir()
+	as.NoError(os.WriteFile(filepath.Join(outsideDir, "outside.txt"), []byte("outside"), 0o644))
+	as.NoError(os.Symlink(outsideDir, filepath.Join(outsideDir, "loop")))
+
+	linksDir := filepath.Join(tempDir, "links")
+	as.NoError(os.MkdirAll(linksDir, 0o755))
+
+	for name, target := range map[string]string{
+		"a.yaml":      "../yaml/test.yaml",
+		"b.yaml":      "../yaml/test.yaml",
+		"dangling":    "missing",
+		"dir":         "../yaml",
+		"outside":     outsideDir,
+		"outside.txt": filepath.Join(outsideDir, "outside.txt"),
+	} {
+		as.NoError(os.Symlink(target, filepath.Join(linksDir, name)))
+	}
+
+	walk := func(path string, policy SymlinkPolicy) map[string]string {
+		paths := make(chan string, 1)
+		paths <- path
+		close(paths)
+
+		walker, err := NewFilesystem(tempDir, paths, Options{Symlinks: policy})
+		as.NoError(err)
+
+		// relative path -> link
+		files := make(map[string]string)
+		as.NoError(walker.Walk(context.Background(), func(file *File, err error) error {
+			as.NoError(err)
+			_, ok := files[file.RelPath]
+			as.False(ok, "file %s emitted more than once", file.RelPath)
+			files[file.RelPath] = file.Link
+			return nil
+		}))
+		return files
+	}
+
+	walkAll := func(policy SymlinkPolicy) map[string]string {
+		return walk(tempDir, policy)
+	}
+
+	files := walkAll(SymlinkSkip)
+	as.Len(files, len(examplesPaths))
+
+	// targets within the tree are emitted through their own path
+	files = walkAll(SymlinkTargetInTree)
+	as.Len(files, len(examplesPaths))
+	as.Equal(filepath.Join(linksDir, "a.yaml"), files["yaml/test.yaml"])
+
+	// targets outside the tree are emitted once, through the path of the first link to them
+	files = walkAll(SymlinkFollow)
+	as.Len(files, len(examplesPaths)+1)
+	as.Contains(files, "links/outside/outside.txt")
+	for relPath := range files {
+		as.False(strings.HasPrefix(relPath, ".."), "%s is outside the tree root", relPath)
+	}
+
+	// the contents of a directory within the tree are emitted through their own path when walking a link to it
+	files = walk(filepath.Join(linksDir, "dir"), SymlinkTargetInTree)
+	as.Equal(map[string]string{"yaml/test.yaml": filepath.Join(linksDir, "dir", "test.yaml")}, files)
+
+	files = walk(filepath.Join(linksDir, "dir"), SymlinkSkip)
+	as.Empty(files)
+
+	// an unknown policy is an error
+	_, err := NewFilesystem(tempDir, make(chan string), Options{Symlinks: "foo"})
+	as.ErrorContains(err, "unknown symlink policy")
+}
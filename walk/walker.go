@@ -14,12 +14,17 @@ const (
 	Git        Type = "git"
 	Auto       Type = "auto"
 	Filesystem Type = "filesystem"
+	Command    Type = "command"
 )
 
 type File struct {
 	Path    string
 	RelPath string
 	Info    fs.FileInfo
+	// Link is the path of the symlink through which the file was found, if any.
+	// Path and RelPath always refer to the file itself, so the same file is emitted under the same path no matter how
+	// it was found.
+	Link string
 }
 
 func (f File) HasChanged() (bool, fs.FileInfo, error) {
@@ -49,6 +54,27 @@ func (f File) String() string {
 	return f.Path
 }
 
+// Options are used to configure a Walker.
+type Options struct {
+	// NoGitignore disables skipping paths ignored by .gitignore files when walking the filesystem.
+	NoGitignore bool
+	// NoUntracked disables emitting files which are not in the git index, but are not ignored, when walking with git.
+	NoUntracked bool
+	// RecurseSubmodules enables walking the index of any initialised submodules when walking with git.
+	RecurseSubmodules bool
+	// SubmoduleConfigFiles are the names of config files which, when present at the root of a submodule, cause it to
+	// be skipped when recursing, as it is formatted as a separate tree with its own config.
+	SubmoduleConfigFiles []string
+	// Symlinks determines how symlinks are handled, defaulting to SymlinkSkip.
+	Symlinks SymlinkPolicy
+	// Command is the command used to list files when walking with a command, which outputs paths relative to the tree
+	// root separated by NUL bytes or newlines. If empty, it is detected using Markers.
+	Command []string
+	// IgnoreFiles are the names of files, at any level of the tree, containing patterns in .gitignore syntax for paths
+	// which should be skipped. Unlike .gitignore files, they apply to tracked files as well.
+	IgnoreFiles []string
+}
+
 type WalkFunc func(file *File, err error) error
 
 type Walker interface {
@@ -56,24 +82,33 @@ type Walker interface {
 	Walk(ctx context.Context, fn WalkFunc) error
 }
 
-func New(walkerType Type, root string, pathsCh chan string) (Walker, error) {
+func New(walkerType Type, root string, pathsCh chan string, opts Options) (Walker, error) {
 	switch walkerType {
 	case Git:
-		return NewGit(root, pathsCh)
+		return NewGit(root, pathsCh, opts)
 	case Auto:
-		return Detect(root, pathsCh)
+		return Detect(root, pathsCh, opts)
 	case Filesystem:
-		return NewFilesystem(root, pathsCh)
+		return NewFilesystem(root, pathsCh, opts)
+	case Command:
+		return NewCommand(root, pathsCh, opts)
 	default:
 		return nil, fmt.Errorf("unknown walker type: %v", walkerType)
 	}
 }
 
-func Detect(root string, pathsCh chan string) (Walker, error) {
-	// for now, we keep it simple and try git first, filesystem second
-	w, err := NewGit(root, pathsCh)
+func Detect(root string, pathsCh chan string, opts Options) (Walker, error) {
+	// a configured command takes precedence, followed by git, then any tools we can detect, then the filesystem.
+	// git is preferred over other tools, as they may be colocated with a git repository, e.g. jj
+	if len(opts.Command) > 0 {
+		return NewCommand(root, pathsCh, opts)
+	}
+
+	w, err := NewGit(root, pathsCh, opts)
 	if err == nil {
 		return w, err
+	} else if detectCommand(root) != nil {
+		return NewCommand(root, pathsCh, opts)
 	}
-	return NewFilesystem(root, pathsCh)
+	return NewFilesystem(root, pathsCh, opts)
 }